@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/philips/smugsync/syncer"
+	"golang.org/x/term"
+)
+
+// accountList is a flag.Value holding accounts given as name:email:apikey.
+// The flag may be given more than once.
+type accountList []syncer.Account
+
+func (l *accountList) String() string {
+	var names []string
+	for _, a := range *l {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *accountList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("account %q should be name:email:apikey", value)
+	}
+	if strings.ContainsAny(parts[0], `/\`+"\x00") || strings.HasPrefix(parts[0], ".") {
+		return fmt.Errorf("account name %q cannot be used as a directory name", parts[0])
+	}
+	for _, a := range *l {
+		if a.Name == parts[0] {
+			return fmt.Errorf("account %q is given twice", parts[0])
+		}
+	}
+	*l = append(*l, syncer.Account{Name: parts[0], Email: parts[1], APIKey: parts[2]})
+	return nil
+}
+
+// findPassword looks up the password for an account in the PASSWORD_NAME
+// environment variable, then the password_name setting in the config file,
+// and finally asks for it if there is a terminal.
+func findPassword(a *syncer.Account) error {
+	key := "password_" + a.Name
+	if s := os.Getenv(strings.ToUpper(key)); s != "" {
+		a.Password = s
+	} else if s := config[key]; s != "" {
+		a.Password = s
+	} else if term.IsTerminal(int(os.Stdin.Fd())) {
+		p, err := readPassword(a.Email)
+		if err != nil {
+			return fmt.Errorf("Unable to read password: %v", err)
+		}
+		a.Password = p
+	}
+	if a.Password == "" {
+		return fmt.Errorf("no password for account %s; set %s or %s in the config file", a.Name, strings.ToUpper(key), key)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/philips/smugsync/syncer"
+)
+
+// runHook runs command with the shell once a sync has changed something,
+// passing the totals in SMUGSYNC_DOWNLOADED, SMUGSYNC_DELETED (which
+// includes files moved to the trash), SMUGSYNC_MOVED (which includes
+// renumbered files), SMUGSYNC_LINKED, and SMUGSYNC_BYTES. Its output goes
+// to stderr along with our own, so that it cannot get mixed into anything
+// we print on stdout.
+func runHook(command string, stats syncer.Stats) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"SMUGSYNC_DOWNLOADED="+strconv.Itoa(stats.Downloaded),
+		"SMUGSYNC_DELETED="+strconv.Itoa(stats.Deleted+stats.Trashed),
+		"SMUGSYNC_MOVED="+strconv.Itoa(stats.Moved+stats.Renumbered),
+		"SMUGSYNC_LINKED="+strconv.Itoa(stats.Linked),
+		"SMUGSYNC_BYTES="+strconv.FormatInt(stats.Bytes, 10),
+	)
+	return cmd.Run()
+}
+
+// changedFiles reports whether a sync with these totals changed anything
+// in the target directory.
+func changedFiles(stats syncer.Stats) bool {
+	return stats.Downloaded+stats.Deleted+stats.Trashed+stats.Moved+stats.Linked+stats.Renumbered > 0
+}
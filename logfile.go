@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// stampWriter starts every line written to it with the current time in
+// the given layout. It stands in for the log package's own date and time,
+// so the same messages can carry different timestamps on the terminal and
+// in a log file.
+type stampWriter struct {
+	w      io.Writer
+	layout string
+}
+
+func (s stampWriter) Write(p []byte) (int, error) {
+	stamp := []byte(time.Now().Format(s.layout) + " ")
+	var b bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) > 0 {
+			b.Write(stamp)
+			b.Write(line)
+		}
+	}
+	if _, err := s.w.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,371 +1,485 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/russross/smugmug"
+	"github.com/philips/smugsync/syncer"
+	"golang.org/x/term"
 )
 
 var (
-	apiKey   string
-	email    string
-	password string
-	dir      string
-	dry      bool
-	del      bool
-	fast     bool
-	jobs     int
-	videos   bool
-	pics     bool
-
-	fileCount  int
-	totalBytes int
+	configFile string
+	config     map[string]string
 )
 
+// exitInterrupted is the exit status when a run is stopped by a signal.
+const exitInterrupted = 130
+
 func main() {
 	start := time.Now()
+	s := syncer.New()
+	var (
+		accounts        accountList
+		quiet, verbose  bool
+		since           string
+		deleteThreshold string
+		maxBandwidth    string
+		maxFileSize     string
+		logFile         string
+		events          string
+		list            bool
+		metricsFile     string
+		newerOnly       bool
+		byAlbum         bool
+		postHook        string
+	)
 
 	// parse config
-	configString(&apiKey, "apikey", "", "SmugMug API key")
-	configString(&email, "email", "", "Email address")
-	configString(&password, "password", "", "Password")
-	configString(&dir, "dir", "", "Target directory")
-	flag.BoolVar(&dry, "dry", false, "Dry run (no changes)")
-	flag.BoolVar(&del, "delete", true, "Delete local files not in album")
-	flag.BoolVar(&fast, "fast", true, "Skip albums with timestamp match")
-	flag.BoolVar(&videos, "videos", true, "Download videos")
-	flag.BoolVar(&pics, "pics", true, "Download pictures")
-	flag.IntVar(&jobs, "jobs", 1, "Number of concurrent jobs to run")
+	configFile = findConfig(os.Args[1:])
+	config = loadConfig(configFile)
+	flag.StringVar(&configFile, "config", configFile, "JSON file with apikey, email, password, and dir settings")
+	configString(&s.APIKey, "apikey", "", "SmugMug API key")
+	configString(&s.Email, "email", "", "Email address")
+	configString(&s.Password, "password", "", "Password")
+	configString(&s.Dir, "dir", "", "Target directory")
+	configString(&s.NickName, "nickname", "", "Sync the public albums of the SmugMug user with this nickname instead of your own")
+	flag.Var(&accounts, "account", "Sync this account into a subdirectory of the target directory, given as name:email:apikey; may be repeated")
+	flag.Var(&dryRun{s}, "dry", "Dry run (no changes); -dry=verify also checks that every file to be downloaded is available with a HEAD request")
+	flag.BoolVar(&list, "list", false, "Print the albums on the server by category, with how many images each has and their total size, and exit without syncing")
+	flag.BoolVar(&s.Verify, "verify", false, "Check local files against the server and report differences without changing anything")
+	flag.BoolVar(&s.DownloadOnly, "download-only", false, "Download everything without scanning or deleting local files; files that already exist are downloaded again")
+	flag.BoolVar(&s.Delete, "delete", true, "Delete local files not in album")
+	flag.BoolVar(&s.PruneEmpty, "prune-empty-albums", false, "Remove album, category, and subcategory directories that are left with no files in them")
+	flag.BoolVar(&s.Fast, "fast", true, "Skip albums with timestamp match")
+	flag.BoolVar(&s.Videos, "videos", true, "Download videos")
+	flag.BoolVar(&s.Pics, "pics", true, "Download pictures")
+	flag.StringVar(&s.Size, "size", "original", "Picture size to download: original, x3large, x2large, xlarge, large, medium, or small")
+	flag.BoolVar(&s.ETags, "etags", false, "Ask the server whether existing videos and resized pictures have changed, using what it said when they were downloaded")
+	flag.BoolVar(&s.Hardlink, "hardlink", false, "Hard link images that are already saved elsewhere instead of downloading them again")
+	flag.BoolVar(&s.Moves, "moves", true, "Move local files that were renamed or moved on the server instead of downloading them again")
+	flag.StringVar(&s.OnConflict, "on-conflict", "server", "What to do with local files changed since the server's copy: server to replace them, skip to leave them and warn, or local to keep them")
+	flag.BoolVar(&newerOnly, "newer-only", false, "Never replace a local file modified more recently than the server's copy, even if it differs; the same as -on-conflict=local, so local edits are kept at the cost of no longer mirroring the server exactly")
+	flag.BoolVar(&s.Number, "number", false, "Start each file name with the image's position in the album, e.g. 001_IMG_4432.jpg")
+	flag.BoolVar(&s.Portable, "portable", s.Portable, "Avoid file names Windows cannot use, such as CON or ones with : or a trailing dot, for targets shared with Windows (the default on Windows); changing this renames such files")
+	flag.BoolVar(&s.IgnoreCase, "ignore-case", false, "Treat local file names that differ only in case as the same file (the default on case-insensitive file systems)")
+	flag.StringVar(&s.ManifestFile, "manifest", "", "Write a JSON list of every image seen and what was done with it to this file; albums skipped over are listed too, as not synced")
+	flag.StringVar(&s.Layout, "layout", "album", "Local layout: album for category/album directories, flat for one directory, or date for year/month directories by the date SmugMug has for each image, not the EXIF time it was taken")
+	flag.StringVar(&s.Template, "template", "", "Go template for the path of each image instead of a layout, using .Category, .SubCategory, .Album, .AlbumKey, .FileName, .Key, .Year, .Month, and .Day (the album layout is "+syncer.AlbumTemplate+"); only the directories it puts images in are cleaned up")
+	flag.BoolVar(&s.Sidecars, "sidecars", false, "Save each image's caption and keywords in a .json file beside it")
+	flag.IntVar(&s.Jobs, "jobs", 1, "Number of albums to sync at once; each album's log is written out when it is done")
+	flag.IntVar(&s.ScanWorkers, "scan-workers", 0, "Number of local files to hash at once across all albums; with -download-workers, albums are scanned while others download (0 for no separate limit)")
+	flag.IntVar(&s.DownloadWorkers, "download-workers", 0, "Number of files to download at once across all albums; raises -jobs so scans and downloads overlap (0 for no separate limit)")
+	flag.Var(&s.Albums, "album", "Only sync albums whose titles match these glob patterns")
+	flag.Var(&s.Categories, "category", "Only sync albums in categories matching these glob patterns")
+	flag.StringVar(&s.Privacy, "privacy", "all", "Only sync public albums, private albums, or all of them")
+	flag.Var(&s.Include, "include", "Only sync files whose names or paths match these glob patterns")
+	flag.Var(&s.Exclude, "exclude", "Skip files whose names or paths match these glob patterns (local copies are kept)")
+	flag.Var(&s.Ignore, "ignore", "Leave local files matching these glob patterns alone, in addition to hidden files, Thumbs.db, and desktop.ini")
+	flag.Var(&s.Protect, "protect", "Leave paths in the target directory matching these glob patterns alone, e.g. README or _exports; they are never scanned or deleted, and images are not saved over them")
+	flag.StringVar(&s.Trash, "trash", "", "Move deleted files into a timestamped directory here instead of removing them")
+	flag.StringVar(&deleteThreshold, "delete-threshold", "", "Ask before deleting more than this many files from an album, or this percentage of them (e.g. 50 or 10%)")
+	flag.BoolVar(&s.Force, "force", false, "Delete files without asking, even past the delete threshold or when an album is listed as empty")
+	flag.StringVar(&s.StartAlbum, "start-album", "", "Skip the albums before this one, given by title or position, to finish an interrupted run; needs -delete=false")
+	flag.StringVar(&since, "since", "", "Only sync images added or changed on or after this date (YYYY-MM-DD)")
+	flag.BoolVar(&quiet, "quiet", false, "Only log warnings, errors, and the final summary")
+	flag.BoolVar(&verbose, "verbose", false, "Log everything, including files that are skipped")
+	flag.StringVar(&events, "events", "", "Write a JSON object for each thing done to this file or named pipe as it happens, one per line (- for stdout)")
+	flag.BoolVar(&byAlbum, "report-by-album", false, "End with how many files were new, changed, skipped, deleted, and failed in each album")
+	flag.StringVar(&postHook, "post-hook", "", "Shell command to run after a sync that downloaded, deleted, moved, or linked something, with the counts in SMUGSYNC_DOWNLOADED, SMUGSYNC_DELETED, SMUGSYNC_MOVED, SMUGSYNC_LINKED, and SMUGSYNC_BYTES; not run for dry runs or when the sync fails")
+	flag.StringVar(&metricsFile, "metrics-file", "", "Write the totals of the run to this file in the Prometheus text format when it is done, for the node_exporter textfile collector")
+	flag.StringVar(&logFile, "logfile", "", "Also append all log output to this file, with RFC 3339 timestamps")
+	flag.BoolVar(&s.KeepGoing, "keep-going", false, "Log errors and continue with the next image or album")
+	flag.IntVar(&s.Retries, "retries", 3, "Number of times to retry a failed download or album listing")
+	flag.DurationVar(&s.Timeout, "timeout", time.Minute, "Time to wait for a server to accept a connection and start responding (0 for no limit)")
+	flag.DurationVar(&s.FileTimeout, "file-timeout", 0, "Give up on a file if downloading it takes longer than this, retries included (0 for no limit); use with -keep-going to carry on past it")
+	flag.StringVar(&s.Proxy, "proxy", "", "Send all requests through this HTTP, HTTPS, or SOCKS5 proxy URL (default from HTTP_PROXY and HTTPS_PROXY)")
+	flag.IntVar(&s.PerHost, "per-host", 4, "Number of downloads to run at once from any one server (0 for no limit)")
+	flag.StringVar(&maxBandwidth, "max-bandwidth", "", "Limit the combined download rate to this many bytes per second, e.g. 2MB")
+	flag.StringVar(&maxFileSize, "max-file-size", "", "Skip images bigger than this, e.g. 100MB (local copies are kept)")
+	flag.BoolVar(&s.Plan, "plan", false, "List every album first and log how many files and bytes will be downloaded before starting")
+	flag.BoolVar(&s.CheckSpace, "check-space", true, "Make sure there is room for everything that will be downloaded before starting")
+	flag.StringVar(&s.TempDir, "tmpdir", "", "Directory to download files into before moving them into place (default beside each file)")
+	flag.StringVar(&s.Checksum, "checksum-algorithm", "md5", "Checksum to record for local files in the cache and manifest: md5, or sha256 to add SHA-256 sums; files are always compared with the server by MD5, the only sum it gives")
+	flag.BoolVar(&s.TrustDirs, "no-scan-unchanged-dirs", false, "Take the files in directories whose modification time has not changed since the last run from the cache instead of looking at each one; faster, but files changed in place without touching their directory are missed")
+	flag.StringVar(&s.CacheFile, "cache", "", "File to cache local MD5 sums in (default .smugsync-cache.json in the target directory)")
 	flag.Parse()
 	if flag.NArg() != 0 {
 		log.Fatalf("Unknown command-line options: %s", strings.Join(flag.Args(), " "))
 	}
-	if apiKey == "" || email == "" || password == "" {
-		log.Fatalf("apikey, email, and password are all required")
+	for _, f := range []string{logFile, metricsFile} {
+		if f != "" {
+			s.OutputFiles = append(s.OutputFiles, f)
+		}
 	}
-	if dir == "" {
-		dir = "."
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("Unable to open log file: %v", err)
+		}
+		defer f.Close()
+		log.SetFlags(0)
+		log.SetOutput(io.MultiWriter(
+			stampWriter{os.Stderr, "2006/01/02 15:04:05"},
+			stampWriter{f, time.RFC3339},
+		))
+	}
+	if len(accounts) > 0 {
+		for i := range accounts {
+			if err := findPassword(&accounts[i]); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		s.Accounts = accounts
+	} else if s.Password == "" && s.APIKey != "" && s.Email != "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		p, err := readPassword(s.Email)
+		if err != nil {
+			log.Fatalf("Unable to read password: %v", err)
+		}
+		s.Password = p
 	}
-	d, err := filepath.Abs(dir)
-	if err != nil {
-		log.Fatalf("Unable to find absolute path for %s: %v", dir, err)
+	switch {
+	case quiet && verbose:
+		log.Fatalf("Only one of quiet and verbose can be set")
+	case quiet:
+		s.Verbosity = syncer.Quiet
+	case verbose:
+		s.Verbosity = syncer.Verbose
 	}
-	dir = d
-
-	// login
-	c, err := smugmug.Login(email, password, apiKey)
-	if err != nil {
-		log.Fatalf("Login error: %v", err)
+	if len(accounts) == 0 && (s.APIKey == "" || s.Email == "" || s.Password == "") {
+		log.Fatalf("apikey, email, and password are all required")
 	}
-	log.Printf("Logged in %s, NickName is %s", email, c.NickName)
-
-	// get full list of albums
-	albums, err := c.Albums(c.NickName)
-	if err != nil {
-		log.Fatalf("Albums error: %v", err)
+	if s.Dir == "" {
+		s.Dir = "."
 	}
-	log.Printf("Found %d albums", len(albums))
-
-	// process each album
-	rate := make(chan struct{}, jobs)
-	for _, album := range albums {
-		rate <- struct{}{}
-		go func(album *smugmug.AlbumInfo) {
-			if err := processAlbum(c, album); err != nil {
-				log.Fatalf("Error processing album %s: %v", album.URL, err)
-			}
-			<-rate
-		}(album)
+	if newerOnly {
+		if s.OnConflict != "server" && s.OnConflict != "local" {
+			log.Fatalf("Only one of newer-only and on-conflict=%s can be set", s.OnConflict)
+		}
+		s.OnConflict = "local"
 	}
-
-	// wait for remaining jobs to finish
-	for i := 0; i < jobs; i++ {
-		rate <- struct{}{}
+	if deleteThreshold != "" {
+		var err error
+		s.Threshold = true
+		if strings.HasSuffix(deleteThreshold, "%") {
+			s.ThresholdPercent, err = strconv.ParseFloat(strings.TrimSuffix(deleteThreshold, "%"), 64)
+		} else {
+			s.ThresholdCount, err = strconv.Atoi(deleteThreshold)
+		}
+		if err != nil || s.ThresholdCount < 0 || s.ThresholdPercent < 0 {
+			log.Fatalf("Invalid delete-threshold %q", deleteThreshold)
+		}
 	}
-
-	if totalBytes > 1024*1024 {
-		log.Printf("Downloaded %d files (%.1fm) in %v", fileCount, float64(totalBytes)/(1024*1024), time.Since(start))
-	} else if totalBytes > 1024 {
-		log.Printf("Downloaded %d files (%.1fk) in %v", fileCount, float64(totalBytes)/1024, time.Since(start))
-	} else {
-		log.Printf("Downloaded %d files (%d bytes) in %v", fileCount, totalBytes, time.Since(start))
+	if since != "" {
+		t, err := time.ParseInLocation("2006-01-02", since, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid since date %q: %v", since, err)
+		}
+		s.Since = t
 	}
-}
-
-func processAlbum(c *smugmug.Conn, album *smugmug.AlbumInfo) error {
-	path := album.Category.Name
-	if album.SubCategory != nil {
-		path = filepath.Join(path, album.SubCategory.Name)
-	}
-	path = filepath.Join(path, album.Title)
-	fullpath := filepath.Join(dir, path)
-	updated, err := time.ParseInLocation("2006-01-02 15:04:05", album.LastUpdated, time.Local)
-	if err != nil {
-		return fmt.Errorf("Unable to parse timestamp %q: %v", album.LastUpdated, err)
+	if maxBandwidth != "" {
+		n, err := syncer.ParseSize(maxBandwidth)
+		if err != nil || n == 0 {
+			log.Fatalf("Invalid max-bandwidth %q", maxBandwidth)
+		}
+		s.MaxBandwidth = n
 	}
-
-	// see if we can skip this based on a time stamp
-	if fast {
-		info, err := os.Stat(fullpath)
-		if err == nil && info.IsDir() && info.ModTime().Equal(updated) {
-			log.Printf("Skipping %s [%s], timestamp of %s matches", path, album.URL, album.LastUpdated)
-			return nil
+	if maxFileSize != "" {
+		n, err := syncer.ParseSize(maxFileSize)
+		if err != nil || n == 0 {
+			log.Fatalf("Invalid max-file-size %q", maxFileSize)
 		}
+		s.MaxFileSize = n
 	}
-
-	log.Printf("Processing %s [%s] (updated %s)", path, album.URL, album.LastUpdated)
-
-	// scan the local directory: map path to md5sum
-	localFiles := make(map[string]string)
-	if info, err := os.Stat(fullpath); err == nil && info.IsDir() {
-		if err := filepath.Walk(fullpath, filepath.WalkFunc(func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			suffix := path
-			if strings.HasPrefix(path, dir+"/") {
-				suffix = path[len(dir)+1:]
-			}
-
-			if info.IsDir() {
-				localFiles[suffix] = "directory"
-				return nil
-			}
-
-			// get an MD5 hash
-			h := md5.New()
-			f, err := os.Open(path)
+	// the API client makes its own requests with the default transport
+	proxy, err := syncer.ProxyFunc(s.Proxy)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.Proxy = proxy
+	}
+	if events != "" {
+		w := os.Stdout
+		if events != "-" {
+			f, err := os.OpenFile(events, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 			if err != nil {
-				log.Printf("error opening %s: %v", path, err)
-				return err
+				log.Fatalf("Unable to open events file: %v", err)
 			}
 			defer f.Close()
-			if _, err = io.Copy(h, f); err != nil {
-				log.Printf("error reading %s: %v", path, err)
-				return err
-			}
-			sum := h.Sum(nil)
-			s := hex.EncodeToString(sum)
-			localFiles[suffix] = s
-			return nil
-		})); err != nil && err != os.ErrNotExist {
-			return fmt.Errorf("error walking local file system: %v", err)
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		s.Events = func(e syncer.Event) {
+			enc.Encode(e)
 		}
 	}
-
-	// get full list of images from this album
-	images, err := c.Images(album)
-	if err != nil {
-		return fmt.Errorf("Images error: %v", err)
+	s.Confirm = confirm
+
+	// stop cleanly on an interrupt: in-flight downloads are abandoned (and
+	// resumed next time) and nothing is cleaned up. A second interrupt
+	// kills the program outright.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if list {
+		albums, err := s.List(ctx)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		printList(albums)
+		return
 	}
 
-	// process each image
-	for _, img := range images {
-		if err := syncFile(album, img, localFiles, dir); err != nil {
-			return fmt.Errorf("Error processing image %s from album %s in category %s: %v",
-				img.FileName, album.Title, album.Category.Name, err)
+	res, err := s.Run(ctx)
+	if metricsFile != "" {
+		if err := writeMetrics(metricsFile, res.Stats, time.Since(start), err == nil && ctx.Err() == nil); err != nil {
+			log.Printf("Unable to write metrics: %v", err)
 		}
 	}
-
-	// delete extra files
-	if err = cleanup(localFiles, dir); err != nil {
-		return fmt.Errorf("Error cleaning up: %v", err)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
 	}
+	stats := res.Stats
 
-	// update the directory timestamp to match
-	if !dry {
-		if err = os.Chtimes(fullpath, updated, updated); err != nil {
-			return fmt.Errorf("failed to set timestamp on directory %s: %v", fullpath, err)
-		}
+	if byAlbum {
+		printAlbumReport(res)
 	}
-
-	return nil
-}
-
-func syncFile(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, localFiles map[string]string, dir string) error {
-	path := album.Category.Name
-	if album.SubCategory != nil {
-		path = filepath.Join(path, album.SubCategory.Name)
-	}
-	path = filepath.Join(path, album.Title)
-	if image.FileName != "" {
-		path = filepath.Join(path, image.FileName)
+	if s.Dry {
+		printDryRun(res)
+		if s.DryCheck {
+			log.Printf("Found %d files that could not be downloaded", stats.Problems)
+		}
+		if s.Size != "original" {
+			log.Printf("Sizes of %s pictures are estimated from the originals, so the totals are upper bounds", s.Size)
+		}
 	} else {
-		return fmt.Errorf("image with no filename: ID=%d Key=%s Album=%v", image.ID, image.Key, image.Album)
+		log.Printf("Downloaded %d files (%s) in %v", stats.Downloaded, syncer.FormatSize(stats.Bytes), time.Since(start))
+		if stats.Trashed > 0 {
+			log.Printf("Moved %d files to %s", stats.Trashed, s.TrashDir())
+		}
+		if stats.Deleted > 0 {
+			log.Printf("Deleted %d files", stats.Deleted)
+		}
 	}
-
-	// skip based on type of file
-	if isVideo(image.Format) && !videos {
-		log.Printf("    skipping video file %s", path)
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
-
-		return nil
-	} else if !isVideo(image.Format) && !pics {
-		log.Printf("    skipping picture file %s", path)
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
-
-		return nil
+	if stats.Conflicts > 0 {
+		log.Printf("Found %d files changed both here and on the server", stats.Conflicts)
 	}
-
-	if localFiles[path] == image.MD5Sum {
-		log.Printf("    skipping unchanged file %s", path)
-
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
-
-		return nil
+	if stats.TooBig > 0 {
+		log.Printf("Skipped %d files over %s", stats.TooBig, syncer.FormatSize(s.MaxFileSize))
 	}
-
-	if localFiles[path] != "" && isVideo(image.Format) {
-		log.Printf("    skipping existing video (assuming unchanged) %s", path)
-
-		// mark this local file as existing on the server
-		delete(localFiles, path)
-		delete(localFiles, filepath.Dir(path))
-
-		return nil
+	if stats.NoOriginal > 0 {
+		log.Printf("Skipped %d files with no original available", stats.NoOriginal)
 	}
-
-	// file is new/changed, so download it
-	fullpath := filepath.Join(dir, path)
-
-	changed := "(new file)"
-	if localFiles[path] != "" {
-		changed = "(file changed)"
+	if s.Verify {
+		log.Printf("Verified %d files, found %d problems", stats.Verified, stats.Problems)
 	}
-
-	// mark this local file as existing on the server
-	delete(localFiles, path)
-	delete(localFiles, filepath.Dir(path))
-
-	if dry {
-		log.Printf("    %s: dry run, no downloading %s", path, changed)
-		totalBytes += image.Size
-		fileCount++
-		return nil
+	if stats.Errors > 0 {
+		log.Printf("Encountered %d errors", stats.Errors)
 	}
-
-	url := image.OriginalURL
-	if isVideo(image.Format) {
-		if image.Video1920URL != "" {
-			url = image.Video1920URL
-		} else if image.Video1280URL != "" {
-			url = image.Video1280URL
-		} else if image.Video960URL != "" {
-			url = image.Video960URL
-		} else if image.Video640URL != "" {
-			url = image.Video640URL
-		} else if image.Video320URL != "" {
-			url = image.Video320URL
-		} else {
-			return fmt.Errorf("no valid url found for video")
+	if ctx.Err() != nil {
+		log.Printf("Interrupted before finishing")
+		os.Exit(exitInterrupted)
+	}
+	if postHook != "" && !s.Dry && !s.Verify && changedFiles(stats) {
+		if err := runHook(postHook, stats); err != nil {
+			log.Printf("ERROR: post-hook failed: %v", err)
+			os.Exit(1)
 		}
 	}
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("error downloading %s: %v", url, err)
+	if stats.Errors > 0 || stats.Problems > 0 {
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code downloading %s: %d", url, resp.StatusCode)
+}
+
+// dryRun is the flag.Value for -dry. It is a boolean flag that also takes
+// "verify" to check the download URLs.
+type dryRun struct {
+	s *syncer.Syncer
+}
+
+func (d *dryRun) String() string {
+	switch {
+	case d.s == nil || !d.s.Dry:
+		return "false"
+	case d.s.DryCheck:
+		return "verify"
 	}
+	return "true"
+}
 
-	// create the directory if necessary
-	if err = os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(fullpath), err)
+func (d *dryRun) Set(value string) error {
+	if value == "verify" {
+		d.s.Dry, d.s.DryCheck = true, true
+		return nil
 	}
-	fp, err := os.Create(fullpath)
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		return fmt.Errorf("failed to open %s for writing: %v", fullpath, err)
+		return fmt.Errorf("dry should be true, false, or verify")
 	}
-	defer fp.Close()
-	size, err := io.Copy(fp, resp.Body)
-	if err != nil {
-		return fmt.Errorf("error saving file %s: %v", fullpath, err)
+	d.s.Dry, d.s.DryCheck = b, false
+	return nil
+}
+
+func (d *dryRun) IsBoolFlag() bool { return true }
+
+// printDryRun logs what a dry run found would change.
+func printDryRun(res *syncer.Result) {
+	var newBytes, changedBytes int64
+	downloads, moves := len(res.Changed), 0
+	for _, f := range res.Downloaded {
+		if f.Status == "moved" {
+			moves++
+			continue
+		}
+		downloads++
+		newBytes += f.Size
 	}
-	if int(size) != image.Size && !isVideo(image.Format) {
-		return fmt.Errorf("downloaded %d bytes from %s, expected %d", size, url, image.Size)
+	for _, f := range res.Changed {
+		changedBytes += f.Size
 	}
-	if size > 1024*1024 {
-		log.Printf("    %s: downloaded %.1fm %s", path, float64(size)/(1024*1024), changed)
-	} else if size > 1024 {
-		log.Printf("    %s: downloaded %.1fk %s", path, float64(size)/1024, changed)
-	} else {
-		log.Printf("    %s: downloaded %d bytes %s", path, size, changed)
+	unchanged := 0
+	for _, f := range res.Skipped {
+		if f.Status == "unchanged" {
+			unchanged++
+		}
+	}
+	log.Printf("Dry run summary:")
+	log.Printf("    %d files to download (%s new, %s changed)", downloads, syncer.FormatSize(newBytes), syncer.FormatSize(changedBytes))
+	if moves > 0 {
+		log.Printf("    %d files to move into place", moves)
 	}
-	totalBytes += int(size)
-	fileCount++
+	log.Printf("    %d files to delete", len(res.Deleted))
+	log.Printf("    %d directories to remove", res.Stats.Dirs)
+	log.Printf("    %d files unchanged, %d skipped", unchanged, len(res.Skipped)-unchanged)
+}
 
-	return nil
+// albumCounts is what happened to the files of one album, for
+// printAlbumReport.
+type albumCounts struct {
+	new, changed, skipped, deleted, failed int
 }
 
-func cleanup(localFiles map[string]string, dir string) error {
-	if !del {
-		return nil
+// printAlbumReport logs how many files of each album were new, changed,
+// skipped, deleted, and failed.
+func printAlbumReport(res *syncer.Result) {
+	counts := make(map[string]*albumCounts)
+	var names []string
+	add := func(files []syncer.File, count func(*albumCounts)) {
+		for _, f := range files {
+			// titles need not be unique, but album paths are
+			name := f.AlbumPath
+			if name == "" {
+				name = "(no album)"
+			}
+			if f.Account != "" {
+				name = f.Account + ": " + name
+			}
+			c, ok := counts[name]
+			if !ok {
+				c = &albumCounts{}
+				counts[name] = c
+				names = append(names, name)
+			}
+			count(c)
+		}
+	}
+	add(res.Downloaded, func(c *albumCounts) { c.new++ })
+	add(res.Changed, func(c *albumCounts) { c.changed++ })
+	add(res.Skipped, func(c *albumCounts) { c.skipped++ })
+	add(res.Deleted, func(c *albumCounts) { c.deleted++ })
+	add(res.Failed, func(c *albumCounts) { c.failed++ })
+	sort.Strings(names)
+	log.Printf("By album:")
+	for _, name := range names {
+		c := counts[name]
+		log.Printf("    %s: %d new, %d changed, %d skipped, %d deleted, %d failed", name, c.new, c.changed, c.skipped, c.deleted, c.failed)
 	}
+}
 
-	// delete local file not found on server
-	for k, v := range localFiles {
-		if v == "directory" {
-			continue
+// printList prints the albums from List as a tree of accounts,
+// categories, and subcategories.
+func printList(albums []syncer.Listing) {
+	sort.SliceStable(albums, func(i, j int) bool {
+		a, b := albums[i], albums[j]
+		if a.Account != b.Account {
+			return a.Account < b.Account
 		}
-		if dry {
-			log.Printf("dry run, not removing file %s", k)
-		} else {
-			fullpath := filepath.Join(dir, k)
-			if err := os.Remove(fullpath); err != nil {
-				return fmt.Errorf("error removing file %s: %v", fullpath, err)
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.SubCategory < b.SubCategory
+	})
+	var last syncer.Listing
+	for i, a := range albums {
+		newAccount := i == 0 || a.Account != last.Account
+		newCategory := newAccount || a.Category != last.Category
+		indent := ""
+		if a.Account != "" {
+			if newAccount {
+				fmt.Println(a.Account)
 			}
+			indent = "    "
 		}
-	}
-
-	// delete directories found but not used
-	for k, v := range localFiles {
-		if v != "directory" {
-			continue
+		if newCategory {
+			fmt.Printf("%s%s\n", indent, a.Category)
 		}
-		if dry {
-			log.Printf("dry run, not removing directory %s", k)
-		} else {
-			fullpath := filepath.Join(dir, k)
-			if err := os.Remove(fullpath); err != nil {
-				return fmt.Errorf("error removing directory %s: %v", fullpath, err)
+		indent += "    "
+		if a.SubCategory != "" {
+			if newCategory || a.SubCategory != last.SubCategory {
+				fmt.Printf("%s%s\n", indent, a.SubCategory)
 			}
+			indent += "    "
 		}
+		fmt.Printf("%s%s (%d images, %s)\n", indent, a.Album, a.Images, syncer.FormatSize(a.Bytes))
+		last = a
 	}
+}
 
-	if len(localFiles) > 0 {
-		log.Printf("removed %d files and directories", len(localFiles))
-	}
+var stdin = bufio.NewReader(os.Stdin)
 
-	return nil
+// confirm asks a yes/no question on the terminal. It returns false without
+// asking if stdin is not a terminal.
+func confirm(question string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
 
 // configString sets a config variable with a string value
 // in ascending priority:
 // 1. Default value passed in
-// 2. Environment variable value (name in upper case)
-// 3. Command-line argument (parameters mimic flag.StringVar)
+// 2. Config file value (same name as the flag)
+// 3. Environment variable value (name in upper case)
+// 4. Command-line argument (parameters mimic flag.StringVar)
 func configString(p *string, name, value, usage string) {
 	if s := os.Getenv(strings.ToUpper(name)); s != "" {
 		// set it to environment value if available
 		*p = s
+	} else if s := config[name]; s != "" {
+		// then the config file
+		*p = s
 	} else {
 		// fall back to default
 		*p = value
@@ -375,14 +489,61 @@ func configString(p *string, name, value, usage string) {
 	flag.StringVar(p, name, *p, usage)
 }
 
-func isVideo(format string) bool {
-	switch format {
-	case "MP4", "AVI":
-		return true
-	case "JPG", "PNG", "GIF":
-		return false
-	default:
-		log.Fatalf("unknown image format: %s", format)
+// findConfig returns the name of the config file. It has to be found
+// before the flags are parsed since the file supplies their defaults, so
+// it scans the arguments for a config flag directly. If there isn't one,
+// the CONFIG environment variable is used, then ~/.smugsync.json.
+func findConfig(args []string) string {
+	name := os.Getenv("CONFIG")
+	if name == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			name = filepath.Join(home, ".smugsync.json")
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		// only flags count, not the values of other flags
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == "config" && i+1 < len(args) {
+			i++
+			name = args[i]
+		} else if strings.HasPrefix(arg, "config=") {
+			name = arg[len("config="):]
+		}
+	}
+	return name
+}
+
+// loadConfig reads a JSON object of settings from the named file. A
+// missing file is not an error.
+func loadConfig(name string) map[string]string {
+	config := make(map[string]string)
+	if name == "" {
+		return config
 	}
-	return false
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return config
+	} else if err != nil {
+		log.Fatalf("Unable to read config file %s: %v", name, err)
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		log.Fatalf("Unable to parse config file %s: %v", name, err)
+	}
+	return config
+}
+
+// readPassword prompts for the password for email and reads it from the
+// terminal without echoing it.
+func readPassword(email string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", email)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(b), err
 }
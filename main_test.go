@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/philips/smugsync/syncer"
+)
+
+func TestFindConfig(t *testing.T) {
+	t.Setenv("CONFIG", "default.json")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "default.json"},
+		{[]string{"--config", "a.json"}, "a.json"},
+		{[]string{"-config=b.json", "--dry"}, "b.json"},
+		// an argument that only looks like the flag is not one
+		{[]string{"--dir", "config", "c.json"}, "default.json"},
+		{[]string{"--dir", "config=c.json"}, "default.json"},
+		{[]string{"--", "--config", "d.json"}, "default.json"},
+	}
+	for _, tt := range tests {
+		if got := findConfig(tt.args); got != tt.want {
+			t.Errorf("findConfig(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	tests := []struct {
+		stats syncer.Stats
+		want  bool
+	}{
+		{syncer.Stats{}, false},
+		{syncer.Stats{Albums: 3, Conflicts: 1}, false},
+		{syncer.Stats{Downloaded: 1}, true},
+		{syncer.Stats{Trashed: 1}, true},
+		{syncer.Stats{Moved: 1}, true},
+		{syncer.Stats{Linked: 1}, true},
+		{syncer.Stats{Renumbered: 1}, true},
+	}
+	for _, tt := range tests {
+		if got := changedFiles(tt.stats); got != tt.want {
+			t.Errorf("changedFiles(%+v) = %v, want %v", tt.stats, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/philips/smugsync/syncer"
+)
+
+// writeMetrics writes the totals of a run to path in the Prometheus text
+// format, for the node_exporter textfile collector. The file is replaced
+// in one step so a scrape never sees half of it.
+func writeMetrics(path string, stats syncer.Stats, took time.Duration, ok bool) error {
+	success := 0
+	if ok {
+		success = 1
+	}
+	var b bytes.Buffer
+	metric := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP smugsync_%s %s\n# TYPE smugsync_%s gauge\nsmugsync_%s %v\n", name, help, name, name, value)
+	}
+	metric("files_downloaded", "Files downloaded by the last run.", stats.Downloaded)
+	metric("bytes_downloaded", "Bytes downloaded by the last run.", stats.Bytes)
+	metric("files_deleted", "Local files deleted or moved to the trash by the last run.", stats.Deleted+stats.Trashed)
+	metric("errors", "Errors skipped over by the last run.", stats.Errors)
+	metric("albums_processed", "Albums looked at by the last run.", stats.Albums)
+	metric("duration_seconds", "How long the last run took.", took.Seconds())
+	metric("success", "Whether the last run finished without stopping on an error.", success)
+	metric("last_run_timestamp_seconds", "When the last run finished.", time.Now().Unix())
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".smugsync-metrics-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// the collector needs to be able to read it
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,225 @@
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheEntry records the MD5 sum of a local file along with the size and
+// modification time the file had when the sum was computed. With another
+// checksum algorithm it records that sum too, and which algorithm it was.
+// For files we downloaded it also records the server's validators for
+// them, so we can ask later whether they have changed.
+type cacheEntry struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	MD5       string    `json:"md5"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`
+	Dir       bool      `json:"dir,omitempty"` // only the mtime, for TrustDirs
+
+	validators
+}
+
+// validators are the response headers a server can compare against to
+// tell us that a file has not changed.
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// known reports whether there is anything to compare against.
+func (v validators) known() bool {
+	return v.ETag != "" || v.LastModified != ""
+}
+
+// md5Cache holds MD5 sums of local files between runs so that unchanged
+// files do not need to be hashed again. Paths are relative to the target
+// directory. It is safe for concurrent use.
+type md5Cache struct {
+	sync.Mutex
+	entries   map[string]cacheEntry
+	algorithm string              // the extra checksum being recorded, or "" for none
+	byDir     map[string][]string // entries by parent directory, made when needed
+}
+
+// loadCache reads the cache file at path. It always returns a usable
+// cache; a missing one is empty, and one that cannot be read is empty and
+// comes with an error worth reporting, since every file will be hashed.
+func loadCache(path string) (*md5Cache, error) {
+	c := &md5Cache{entries: make(map[string]cacheEntry)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return c, fmt.Errorf("Unable to read cache %s, hashing all files: %v", path, err)
+		}
+		return c, nil
+	}
+	if err = json.Unmarshal(data, &c.entries); err != nil {
+		c.entries = make(map[string]cacheEntry)
+		return c, fmt.Errorf("Unable to parse cache %s, hashing all files: %v", path, err)
+	}
+	return c, nil
+}
+
+// lookup returns the cached sum for path if the file still has the size
+// and modification time it had when the sum was recorded. An entry without
+// the extra checksum being recorded is a miss, so the file is hashed
+// again after the algorithm is changed.
+func (c *md5Cache) lookup(path string, info os.FileInfo) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[path]
+	if !ok || !e.matches(info) || e.MD5 == "" || e.Algorithm != c.algorithm {
+		return "", false
+	}
+	return e.MD5, true
+}
+
+// lookupChecksum returns the extra checksum recorded for path, if there
+// is one and the file has not changed since.
+func (c *md5Cache) lookupChecksum(path string, info os.FileInfo) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[path]
+	if !ok || !e.matches(info) || c.algorithm == "" || e.Algorithm != c.algorithm {
+		return "", false
+	}
+	return e.Checksum, true
+}
+
+// matches reports whether the file still looks the way it did when the
+// entry was made.
+func (e cacheEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// store records the sums for path, keeping any validators for it. Without
+// the extra checksum the file is hashed again if one is being recorded.
+func (c *md5Cache) store(path string, info os.FileInfo, sum, checksum string) {
+	c.Lock()
+	defer c.Unlock()
+	e := cacheEntry{Size: info.Size(), ModTime: info.ModTime(), MD5: sum}
+	if c.algorithm != "" && checksum != "" {
+		e.Algorithm, e.Checksum = c.algorithm, checksum
+	}
+	if old, ok := c.entries[path]; ok && old.matches(info) {
+		e.validators = old.validators
+	}
+	c.entries[path] = e
+}
+
+// lookupValidators returns the validators recorded for path if the file
+// has not changed since.
+func (c *md5Cache) lookupValidators(path string, info os.FileInfo) (validators, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[path]
+	if !ok || !e.matches(info) || !e.validators.known() {
+		return validators{}, false
+	}
+	return e.validators, true
+}
+
+// storeDownload records the sums and validators for a file just
+// downloaded to path.
+func (c *md5Cache) storeDownload(path string, info os.FileInfo, sum, checksum string, v validators) {
+	c.Lock()
+	defer c.Unlock()
+	e := cacheEntry{Size: info.Size(), ModTime: info.ModTime(), MD5: sum, validators: v}
+	if c.algorithm != "" {
+		e.Algorithm, e.Checksum = c.algorithm, checksum
+	}
+	c.entries[path] = e
+}
+
+// unchangedDir reports whether the directory at path still has the
+// modification time it had when it was last scanned in full.
+func (c *md5Cache) unchangedDir(path string, info os.FileInfo) bool {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[path]
+	return ok && e.Dir && e.ModTime.Equal(info.ModTime())
+}
+
+// storeDir records the modification time of a directory that has just
+// been scanned in full.
+func (c *md5Cache) storeDir(path string, info os.FileInfo) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[path] = cacheEntry{ModTime: info.ModTime(), Dir: true}
+}
+
+// lookupSum returns the sum recorded for path without checking the file,
+// for a directory that has not changed.
+func (c *md5Cache) lookupSum(path string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[path]
+	return e.MD5, ok && e.MD5 != ""
+}
+
+// children returns the files and directories with entries directly inside
+// the directory at path. They are grouped by directory the first time this
+// is called; a directory that has changed since then is not unchanged, so
+// the grouping only needs checking against entries that have been removed.
+// It reports false if any file's entry has no usable sum, say because the
+// checksum algorithm changed, since then the directory must be scanned.
+func (c *md5Cache) children(path string) (files, dirs []string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.byDir == nil {
+		c.byDir = make(map[string][]string)
+		for k := range c.entries {
+			parent := filepath.Dir(k)
+			c.byDir[parent] = append(c.byDir[parent], k)
+		}
+	}
+	for _, k := range c.byDir[path] {
+		e, found := c.entries[k]
+		switch {
+		case !found || k == path:
+		case e.Dir:
+			dirs = append(dirs, k)
+		case e.MD5 != "" && e.Algorithm == c.algorithm:
+			files = append(files, k)
+		default:
+			return nil, nil, false
+		}
+	}
+	return files, dirs, true
+}
+
+// remove forgets about path.
+func (c *md5Cache) remove(path string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, path)
+}
+
+// save writes the cache to path, replacing the old file only once the new
+// one has been written in full.
+func (c *md5Cache) save(path string) error {
+	c.Lock()
+	data, err := json.Marshal(c.entries)
+	c.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding cache: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(path), err)
+	}
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing cache %s: %v", tmp, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, path, err)
+	}
+	return nil
+}
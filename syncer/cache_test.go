@@ -0,0 +1,268 @@
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+func TestCacheAlgorithmChange(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.jpg", "picture")
+	info, err := os.Stat(filepath.Join(dir, "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	// sums recorded with only MD5...
+	c, err := loadCache(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.store("a.jpg", info, "md5sum", "")
+	if err := c.save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...are not trusted once SHA-256 sums are wanted too
+	c, err = loadCache(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.algorithm = "sha256"
+	if sum, ok := c.lookup("a.jpg", info); ok {
+		t.Errorf("lookup after changing algorithm = %q, want a miss", sum)
+	}
+	if _, ok := c.lookupChecksum("a.jpg", info); ok {
+		t.Errorf("lookupChecksum after changing algorithm hit")
+	}
+
+	c.store("a.jpg", info, "md5sum", "shasum")
+	if sum, ok := c.lookup("a.jpg", info); !ok || sum != "md5sum" {
+		t.Errorf("lookup = %q, %v; want md5sum", sum, ok)
+	}
+	if sum, ok := c.lookupChecksum("a.jpg", info); !ok || sum != "shasum" {
+		t.Errorf("lookupChecksum = %q, %v; want shasum", sum, ok)
+	}
+
+	// and going back is a change too
+	c.algorithm = ""
+	if _, ok := c.lookup("a.jpg", info); ok {
+		t.Errorf("lookup after dropping the algorithm hit")
+	}
+}
+
+func TestScanRehashesAfterAlgorithmChange(t *testing.T) {
+	s := newTestSyncer(t)
+	writeFile(t, s.Dir, "a.jpg", "picture")
+	if err := s.scan(context.Background(), s.Dir, true, newFileSet(false)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.localChecksum("a.jpg"); got != "" {
+		t.Fatalf("localChecksum with md5 = %q, want none", got)
+	}
+
+	s.Checksum = "sha256"
+	s.cache.algorithm = s.checksumAlgorithm()
+	if err := s.scan(context.Background(), s.Dir, true, newFileSet(false)); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("picture"))
+	want := "sha256:" + hex.EncodeToString(sum[:])
+	if got := s.localChecksum("a.jpg"); got != want {
+		t.Errorf("localChecksum after changing algorithm = %q, want %q", got, want)
+	}
+}
+
+func TestRelativeCacheFileNotScanned(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	s := New()
+	s.CacheFile = "my-cache.json"
+	if err := s.prepare(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(s.cacheFile) {
+		t.Fatalf("cache file %q is not absolute", s.cacheFile)
+	}
+	writeFile(t, dir, "a.jpg", "picture")
+	writeFile(t, dir, "my-cache.json", "{}")
+	s.loadCache()
+	files := newFileSet(false)
+	if err := s.scan(context.Background(), s.Dir, true, files); err != nil {
+		t.Fatal(err)
+	}
+	if files.get("my-cache.json") != "" {
+		t.Errorf("the cache file was scanned as a local file")
+	}
+	if files.get("a.jpg") == "" {
+		t.Errorf("a.jpg was not scanned")
+	}
+}
+
+func TestTrustedDirKeptAfterCacheSave(t *testing.T) {
+	s := newTestSyncer(t)
+	s.TrustDirs = true
+	s.cacheFile = filepath.Join(s.Dir, ".smugsync-cache.json")
+	writeFile(t, s.Dir, "Other/Trip/a.jpg", "a")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(s.Dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scan(context.Background(), s.Dir, true, newFileSet(false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache file is new, but the directory is still taken as unchanged
+	s.loadCache()
+	info, err := os.Stat(s.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) || !s.cache.unchangedDir(".", info) {
+		t.Errorf("saving the cache changed the target directory's time from %v to %v", old, info.ModTime())
+	}
+
+	// but not when something else changed it after the scan
+	writeFile(t, s.Dir, "b.jpg", "b")
+	if err := s.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.Dir); err != nil || info.ModTime().Equal(old) {
+		t.Errorf("saving the cache put back the time of a directory that changed")
+	}
+}
+
+func TestCreatedFilesCached(t *testing.T) {
+	const sumA, sumB = "0cc175b9c0f1b6a831c399e269772661", "92eb5ffee6ae2fec3ad71c777531578f"
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "a")
+	}))
+	defer web.Close()
+	image := func(key, name, sum string) *smugmug.ImageInfo {
+		return &smugmug.ImageInfo{Key: key, FileName: name, Format: "JPG", Size: 1, MD5Sum: sum, OriginalURL: web.URL}
+	}
+	trip, other := testAlbum("Trip"), testAlbum("Another")
+
+	tests := []struct {
+		name   string
+		setup  func(s *Syncer)
+		local  map[string]string
+		albums map[*smugmug.AlbumInfo][]*smugmug.ImageInfo
+		want   map[string]string
+	}{
+		{
+			name:   "moved",
+			local:  map[string]string{"Other/Trip/old.jpg": "a"},
+			albums: map[*smugmug.AlbumInfo][]*smugmug.ImageInfo{trip: {image("a", "a.jpg", sumA)}},
+			want:   map[string]string{"Other/Trip/a.jpg": sumA},
+		},
+		{
+			name:  "renumbered",
+			setup: func(s *Syncer) { s.Number = true },
+			local: map[string]string{"Other/Trip/001_a.jpg": "a", "Other/Trip/002_b.jpg": "b"},
+			albums: map[*smugmug.AlbumInfo][]*smugmug.ImageInfo{
+				trip: {image("b", "b.jpg", sumB), image("a", "a.jpg", sumA)}},
+			want: map[string]string{"Other/Trip/001_b.jpg": sumB, "Other/Trip/002_a.jpg": sumA},
+		},
+		{
+			name:  "linked",
+			setup: func(s *Syncer) { s.Hardlink = true },
+			albums: map[*smugmug.AlbumInfo][]*smugmug.ImageInfo{
+				trip: {image("a", "a.jpg", sumA)}, other: {image("a2", "a.jpg", sumA)}},
+			want: map[string]string{"Other/Trip/a.jpg": sumA, "Other/Another/a.jpg": sumA},
+		},
+	}
+	for _, tt := range tests {
+		server := &fakeServer{images: make(map[string][]*smugmug.ImageInfo)}
+		for album, images := range tt.albums {
+			server.albums = append(server.albums, album)
+			server.images[album.Key] = images
+		}
+		useFakeServer(t, server)
+		s := New()
+		s.Dir = t.TempDir()
+		s.CheckSpace = false
+		if tt.setup != nil {
+			tt.setup(s)
+		}
+		for rel, content := range tt.local {
+			writeFile(t, s.Dir, rel, content)
+		}
+		res, err := s.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Stats.Errors != 0 {
+			t.Errorf("%s: run had %d errors", tt.name, res.Stats.Errors)
+		}
+
+		c, err := loadCache(filepath.Join(s.Dir, ".smugsync-cache.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rel, want := range tt.want {
+			info, err := os.Stat(filepath.Join(s.Dir, rel))
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			if sum, ok := c.lookup(rel, info); !ok || sum != want {
+				t.Errorf("%s: cached sum of %s = %q, %v; want %s", tt.name, rel, sum, ok, want)
+			}
+		}
+	}
+}
+
+func TestCacheSavedWhenRunFails(t *testing.T) {
+	trip := testAlbum("Trip")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{trip, testAlbum("Broken")},
+		images: map[string][]*smugmug.ImageInfo{trip.Key: {{Key: "a", FileName: "a.jpg", Format: "JPG", Size: 1,
+			MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}}},
+		// the album list and the first album's listing succeed
+		fail: []error{nil, nil, errors.New("album not found")},
+	}
+	useFakeServer(t, server)
+	s := New()
+	s.Dir = t.TempDir()
+	s.CheckSpace = false
+	writeFile(t, s.Dir, "Other/Trip/a.jpg", "a")
+	if _, err := s.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded with an album that cannot be listed")
+	}
+
+	c, err := loadCache(filepath.Join(s.Dir, ".smugsync-cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(s.Dir, "Other/Trip/a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.lookup("Other/Trip/a.jpg", info); !ok {
+		t.Errorf("the sum hashed before the failure was not saved")
+	}
+}
@@ -0,0 +1,52 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// checksums are the algorithms that can be chosen for the extra checksum
+// recorded for each local file. MD5 sums are always worked out as well,
+// since they are the only sums the server gives us to compare against;
+// choosing md5 records nothing extra.
+var checksums = map[string]func() hash.Hash{
+	"md5":    nil,
+	"sha256": sha256.New,
+}
+
+// newChecksum returns a hash for the extra checksum, or nil if there is
+// none.
+func (s *Syncer) newChecksum() hash.Hash {
+	if f := checksums[s.Checksum]; f != nil {
+		return f()
+	}
+	return nil
+}
+
+// checksumAlgorithm returns the name of the extra checksum, or "" if
+// there is none.
+func (s *Syncer) checksumAlgorithm() string {
+	if checksums[s.Checksum] == nil {
+		return ""
+	}
+	return s.Checksum
+}
+
+// localChecksum returns the extra checksum of the local file at path, as
+// algorithm:sum for the manifest, or "" if there is none.
+func (s *Syncer) localChecksum(path string) string {
+	if s.checksumAlgorithm() == "" {
+		return ""
+	}
+	info, err := os.Stat(filepath.Join(s.Dir, path))
+	if err != nil {
+		return ""
+	}
+	sum, ok := s.cache.lookupChecksum(path, info)
+	if !ok || sum == "" {
+		return ""
+	}
+	return s.Checksum + ":" + sum
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package syncer
+
+// freeSpace is not implemented on this platform, so the disk space check
+// is skipped.
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,925 @@
+package syncer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+func (s *albumJob) syncFile(ctx context.Context, album *smugmug.AlbumInfo, image *smugmug.ImageInfo, localFiles *fileSet) (err error) {
+	// note what happened to this image in the manifest
+	entry := s.manifestEntry(album, image)
+	size := int64(image.Size)
+	var took time.Duration
+	defer func() {
+		if err != nil {
+			entry.Status = "failed"
+		}
+		if s.ManifestFile != "" {
+			s.inventory.add(entry)
+		}
+		s.countFile(File{
+			Account:   s.accountName,
+			Album:     album.Title,
+			AlbumPath: s.albumPath(album),
+			Path:      entry.Path,
+			Size:      size,
+			Status:    entry.Status,
+			Duration:  took,
+			Err:       err,
+		})
+	}()
+
+	path, err := s.imagePath(album, image)
+	if err != nil {
+		return err
+	}
+	entry.Path = path
+	if image.FileName == "" {
+		s.warnf("WARNING: image %s in %s has no file name, saving it as %s", image.Key, album.Title, path)
+	}
+
+	// skip images the user does not want, leaving any local copy where it
+	// is: protected files are never written over, and filtered, skipped,
+	// too big, and old images are left out of cleanup
+	if reason := s.skipped(image, path); reason != "" {
+		switch reason {
+		case "protected":
+			s.warnf("    %s: protected, skipping", path)
+		case "filtered":
+			s.debugf("    skipping filtered file %s", path)
+		case "skipped":
+			if isVideo(image.Format) {
+				s.debugf("    skipping video file %s", path)
+			} else {
+				s.debugf("    skipping picture file %s", path)
+			}
+		case "too big":
+			s.debugf("    skipping %s file %s", FormatSize(int64(image.Size)), path)
+			s.countTooBig()
+		case "old":
+			s.debugf("    skipping old file %s", path)
+		}
+		entry.Status = reason
+		s.keepImage(path, localFiles)
+		return nil
+	}
+
+	if s.Verify {
+		entry.Status = s.verifyFile(image, path, localFiles)
+		return nil
+	}
+
+	if s.Sidecars {
+		if err := s.syncSidecar(album, image, path, localFiles); err != nil {
+			return err
+		}
+	}
+
+	// videos and resized copies cannot be checked against the listing's
+	// MD5 sum, so unless the server can tell us whether they have changed
+	// we assume they have not
+	local := localFiles.get(path)
+	var known validators
+	if local != "" && local != image.MD5Sum && s.ETags && !s.Dry {
+		if info, err := os.Stat(filepath.Join(s.Dir, path)); err == nil {
+			known, _ = s.cache.lookupValidators(path, info)
+		}
+	}
+	url, resized := s.imageURL(image)
+
+	switch s.localStatus(image, path, local, known) {
+	case "unchanged":
+		switch {
+		case local == image.MD5Sum:
+			s.debugf("    skipping unchanged file %s", path)
+			entry.Checksum = s.localChecksum(path)
+		case isVideo(image.Format):
+			s.debugf("    skipping existing video (assuming unchanged) %s", path)
+		default:
+			s.debugf("    skipping existing %s copy (assuming unchanged) %s", s.Size, path)
+		}
+		entry.Status = "unchanged"
+		s.keepImage(path, localFiles)
+		return nil
+	case "conflict":
+		// a local copy that changed after the server's copy did was
+		// probably edited here, and downloading would throw the edit away
+		s.countConflict()
+		switch s.OnConflict {
+		case "skip":
+			s.warnf("    %s: changed both here and on the server, skipping", path)
+			entry.Status = "conflict"
+			s.keepImage(path, localFiles)
+			return nil
+		case "local":
+			s.infof("    %s: changed here since the server's copy, keeping it", path)
+			entry.Status = "conflict"
+			s.keepImage(path, localFiles)
+			return nil
+		default:
+			s.warnf("    %s: changed both here and on the server, replacing it with the server's copy", path)
+		}
+	}
+
+	// file is new/changed, so download it
+	fullpath := filepath.Join(s.Dir, path)
+
+	isNew := local == ""
+	changed := "(file changed)"
+	entry.Status = "changed"
+	if isNew {
+		changed = "(new file)"
+		entry.Status = "new"
+	}
+	s.keepImage(path, localFiles)
+
+	// only an original can be checked against the listing
+	expect := image
+	if resized || isVideo(image.Format) {
+		expect = nil
+	}
+	if resized && url != "" && sizeURLs[s.Size](image) == "" {
+		s.infof("    %s: no %s size available, downloading original", path, s.Size)
+	}
+	entry.URL = url
+
+	// a new file may be one we already have under another name
+	original := !isVideo(image.Format) && !resized
+	if s.moves && original && isNew {
+		if src, ok := s.orphans.take(image.MD5Sum); ok {
+			// it may have come from this album, in which case it is no
+			// longer an extra file
+			rel, _ := filepath.Rel(s.Dir, src)
+			entry.Status = "moved"
+			if s.Dry {
+				s.infof("    %s: dry run, not moving from %s", path, src)
+				localFiles.remove(rel)
+				return nil
+			}
+			checksum := s.knownChecksum(rel)
+			err := s.moveFile(src, fullpath, image.Size)
+			if err == nil {
+				s.infof("    %s: moved from %s", path, src)
+				localFiles.remove(rel)
+				s.cache.remove(rel)
+				s.storeCreated(path, image.MD5Sum, checksum)
+				return nil
+			}
+			s.warnf("    %s: unable to move from %s, downloading instead: %v", path, src, err)
+			entry.Status = "new"
+		}
+	}
+
+	// some images, videos especially, have nothing the API will let us
+	// download; they are skipped rather than failing the album
+	if url == "" {
+		s.warnf("    %s: no original available, skipping", path)
+		entry.Status = "no original"
+		s.countNoOriginal()
+		return nil
+	}
+
+	if s.Dry {
+		if s.DryCheck {
+			err := s.withRetry(ctx, path, func() error {
+				return s.checkURL(ctx, url, expect)
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				s.countProblem("    %s: %v", path, err)
+			} else {
+				s.debugf("    %s: %s is available", path, url)
+			}
+		}
+		// the size of a resized copy is not known in advance, so the
+		// original's size stands in as an upper bound
+		if resized {
+			s.infof("    %s: dry run, no downloading %s (size estimated from original)", path, changed)
+		} else {
+			s.infof("    %s: dry run, no downloading %s", path, changed)
+		}
+		s.countDownload(int64(image.Size))
+		return nil
+	}
+
+	// an identical file may already be saved from another album
+	if s.Hardlink && expect != nil {
+		if src, ok := s.saved.lookup(image.MD5Sum); ok && src != fullpath {
+			rel, _ := filepath.Rel(s.Dir, src)
+			checksum := s.knownChecksum(rel)
+			err := s.linkFile(src, fullpath, image.Size)
+			if err == nil {
+				s.infof("    %s: linked to %s %s", path, src, changed)
+				entry.Status = "linked"
+				s.storeCreated(path, image.MD5Sum, checksum)
+				return nil
+			}
+			s.warnf("    %s: unable to link to %s, downloading instead: %v", path, src, err)
+		}
+	}
+
+	// a stalled download is given up on after FileTimeout, so it cannot
+	// hold up the rest of the run
+	fileCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.FileTimeout > 0 {
+		fileCtx, cancel = context.WithTimeout(ctx, s.FileTimeout)
+	}
+	defer cancel()
+	var got fetched
+	started := time.Now()
+	err = s.withRetry(fileCtx, path, func() error {
+		var err error
+		got, err = s.download(fileCtx, url, fullpath, expect, known)
+		return err
+	})
+	took = time.Since(started)
+	if fileCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		os.Remove(s.partialPath(fullpath))
+		return fmt.Errorf("download did not finish within %v", s.FileTimeout)
+	}
+	if err == errNotModified {
+		s.debugf("    skipping unchanged file %s (not modified on the server)", path)
+		entry.Status = "unchanged"
+		size = int64(image.Size)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size = got.size
+
+	if s.Hardlink && expect != nil {
+		s.saved.add(image.MD5Sum, fullpath)
+	}
+
+	// date the file by when it was taken so it sorts sensibly
+	if t, ok := captureTime(fullpath, image); ok {
+		if err = os.Chtimes(fullpath, t, t); err != nil {
+			s.warnf("    %s: failed to set timestamp: %v", path, err)
+		}
+	}
+
+	// the sum is already known, so the next scan need not read the file
+	// again, and the validators let us ask the server about it next time
+	if info, err := os.Stat(fullpath); err == nil {
+		s.cache.storeDownload(path, info, got.md5, got.checksum, got.validators)
+	}
+	if got.checksum != "" {
+		entry.Checksum = s.Checksum + ":" + got.checksum
+	}
+
+	s.infof("    %s: downloaded %s %s", path, FormatSize(size), changed)
+	s.countDownload(size)
+
+	return nil
+}
+
+// skipped returns why syncFile leaves image alone without looking at any
+// local copy: "protected", "filtered", "skipped" for a type that is not
+// being synced, "too big", or "old"; or "" if it is to be synced.
+func (s *Syncer) skipped(image *smugmug.ImageInfo, path string) string {
+	switch {
+	case s.protected(path):
+		return "protected"
+	case !s.wantFile(path):
+		return "filtered"
+	case isVideo(image.Format) && !s.Videos, !isVideo(image.Format) && !s.Pics:
+		return "skipped"
+	case s.tooBig(image):
+		return "too big"
+	}
+	if !s.Since.IsZero() {
+		if t, ok := imageTime(image); ok && t.Before(s.Since) {
+			return "old"
+		}
+	}
+	return ""
+}
+
+// localStatus returns what syncFile makes of the local copy of image at
+// path, given its MD5 sum (or "" if there is none) and any validators the
+// server gave for it: "new" if there is none, "unchanged" if it can be
+// kept, "conflict" if it was changed here since the server's copy was, or
+// else "changed".
+func (s *Syncer) localStatus(image *smugmug.ImageInfo, path, local string, known validators) string {
+	resized := !isVideo(image.Format) && s.Size != "original"
+	switch {
+	case local == "":
+		return "new"
+	case local == image.MD5Sum:
+		return "unchanged"
+	case isVideo(image.Format) && !known.known():
+		return "unchanged"
+	case resized && !known.known():
+		// resized copies do not match the MD5 sum of the original, so
+		// the best we can do is download them when they are missing
+		return "unchanged"
+	case s.editedLocally(path, image):
+		return "conflict"
+	}
+	return "changed"
+}
+
+// imageURL returns the URL to download image from, or "" if the API gives
+// none, and whether it is for a resized copy. A picture without the size
+// asked for falls back to the original, which still counts as resized
+// since it cannot be checked against the listing either way.
+func (s *Syncer) imageURL(image *smugmug.ImageInfo) (string, bool) {
+	if isVideo(image.Format) {
+		for _, url := range []string{image.Video1920URL, image.Video1280URL, image.Video960URL, image.Video640URL, image.Video320URL} {
+			if url != "" {
+				return url, false
+			}
+		}
+		return "", false
+	}
+	if s.Size == "original" {
+		return image.OriginalURL, false
+	}
+	if url := sizeURLs[s.Size](image); url != "" {
+		return url, true
+	}
+	return image.OriginalURL, true
+}
+
+// sidecarSuffix is appended to an image's file name to name its sidecar.
+const sidecarSuffix = ".json"
+
+// keepImage leaves the local copy of the image at path, and its sidecar,
+// out of cleanup.
+func (s *Syncer) keepImage(path string, localFiles *fileSet) {
+	localFiles.keep(path)
+	if s.Sidecars {
+		localFiles.keep(path + sidecarSuffix)
+	}
+}
+
+// sidecar is the metadata saved beside each image with --sidecars.
+type sidecar struct {
+	FileName    string `json:"filename"`
+	Category    string `json:"category"`
+	SubCategory string `json:"subcategory,omitempty"`
+	Album       string `json:"album"`
+	Caption     string `json:"caption,omitempty"`
+	Keywords    string `json:"keywords,omitempty"`
+	Date        string `json:"date,omitempty"`
+}
+
+// syncSidecar writes the sidecar for the image at path, unless the local
+// copy is already current. Sidecars are tracked in localFiles like any
+// other file, so cleanup removes the ones whose images are gone.
+func (s *albumJob) syncSidecar(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, path string, localFiles *fileSet) error {
+	meta := sidecar{
+		FileName: image.FileName,
+		Category: album.Category.Name,
+		Album:    album.Title,
+		Caption:  image.Caption,
+		Keywords: image.Keywords,
+		Date:     image.Date,
+	}
+	if album.SubCategory != nil {
+		meta.SubCategory = album.SubCategory.Name
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sidecar: %v", err)
+	}
+	data = append(data, '\n')
+	sum := md5.Sum(data)
+
+	spath := path + sidecarSuffix
+	old := localFiles.get(spath)
+	localFiles.keep(spath)
+	if old == hex.EncodeToString(sum[:]) {
+		return nil
+	}
+	if s.Dry {
+		s.infof("    %s: dry run, not writing sidecar", spath)
+		return nil
+	}
+
+	fullpath := filepath.Join(s.Dir, spath)
+	if err = s.dirs.mkdirAll(filepath.Dir(fullpath)); err != nil {
+		return err
+	}
+	tmp := fullpath + partialSuffix
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing sidecar %s: %v", tmp, err)
+	}
+	if err = os.Rename(tmp, fullpath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, fullpath, err)
+	}
+	extra := s.newChecksum()
+	if extra != nil {
+		extra.Write(data)
+	}
+	s.storeCreated(spath, hex.EncodeToString(sum[:]), hashSum(extra))
+	s.infof("    %s: wrote sidecar", spath)
+	return nil
+}
+
+// isVideo reports whether format is one of the video formats. Formats it
+// does not know, such as ones the server adds later, are taken to be
+// pictures.
+func isVideo(format string) bool {
+	switch format {
+	case "MP4", "AVI":
+		return true
+	}
+	return false
+}
+
+// sizeURLs maps the names accepted by --size to the matching URL in an
+// image listing.
+var sizeURLs = map[string]func(*smugmug.ImageInfo) string{
+	"original": func(i *smugmug.ImageInfo) string { return i.OriginalURL },
+	"x3large":  func(i *smugmug.ImageInfo) string { return i.X3LargeURL },
+	"x2large":  func(i *smugmug.ImageInfo) string { return i.X2LargeURL },
+	"xlarge":   func(i *smugmug.ImageInfo) string { return i.XLargeURL },
+	"large":    func(i *smugmug.ImageInfo) string { return i.LargeURL },
+	"medium":   func(i *smugmug.ImageInfo) string { return i.MediumURL },
+	"small":    func(i *smugmug.ImageInfo) string { return i.SmallURL },
+}
+
+// imageTime returns when an image was last changed on the server, or when
+// it was uploaded if that is all we have.
+func imageTime(image *smugmug.ImageInfo) (time.Time, bool) {
+	for _, s := range []string{image.LastUpdated, image.Date} {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// editedLocally reports whether the local copy of image at path was
+// modified after the image was last changed on the server. Downloads are
+// dated by when they were taken, so this normally means it was edited
+// here.
+func (s *Syncer) editedLocally(path string, image *smugmug.ImageInfo) bool {
+	t, ok := imageTime(image)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(s.Dir, path))
+	return err == nil && info.ModTime().After(t)
+}
+
+// captureTime returns the best available time for when an image was
+// taken: the EXIF timestamp for a JPEG, or else the date SmugMug reports.
+func captureTime(fullpath string, image *smugmug.ImageInfo) (time.Time, bool) {
+	if image.Format == "JPG" {
+		if t, ok := exifTime(fullpath); ok {
+			return t, true
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", image.Date, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// partialSuffix is appended to the name of a file while it is being
+// downloaded. The file is only renamed into place once it has been checked,
+// so an interrupted run never leaves a bad file under the real name. If the
+// transfer itself is cut short, the partial file is left in place so a
+// later attempt can resume where it stopped; on any other failure it is
+// removed.
+const partialSuffix = ".part"
+
+// partialPath returns where the partial download of fullpath is kept:
+// beside it, or in TempDir if one is set. Names in TempDir are derived
+// from the whole path, so concurrent downloads of files with the same
+// name do not collide and an interrupted download is found again.
+func (s *Syncer) partialPath(fullpath string) string {
+	if s.TempDir == "" {
+		return fullpath + partialSuffix
+	}
+	sum := md5.Sum([]byte(fullpath))
+	return filepath.Join(s.TempDir, hex.EncodeToString(sum[:8])+"_"+filepath.Base(fullpath)+partialSuffix)
+}
+
+// errNotModified is returned by download when the server says the local
+// copy is current.
+var errNotModified = errors.New("not modified")
+
+// throttledPause is how long to hold off all downloads when a server says
+// there are too many requests without saying how long to wait.
+const throttledPause = 30 * time.Second
+
+// fetched describes a finished download: its size, its MD5 sum and extra
+// checksum, which are worked out as the data is written, and the server's
+// validators for it.
+type fetched struct {
+	size     int64
+	md5      string
+	checksum string
+	validators
+}
+
+// download fetches url and saves it to fullpath. The data is written to
+// a partial file first and resumed with a range request if a partial file
+// already exists. If expect is not nil, the result is checked against its
+// size and MD5 sum; otherwise nothing would catch a partial file of an
+// older version being finished with a newer one, so it is started over
+// instead of being resumed. If known validators are given, the request is made
+// conditional on them and errNotModified is returned if the copy we have
+// is current. Failures that are likely to be transient are wrapped in
+// retryableError.
+func (s *albumJob) download(ctx context.Context, url, fullpath string, expect *smugmug.ImageInfo, known validators) (fetched, error) {
+	partial := s.partialPath(fullpath)
+	var offset int64
+	if info, err := os.Stat(partial); err == nil && expect != nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fetched{}, fmt.Errorf("error creating request for %s: %v", url, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if known.ETag != "" {
+		req.Header.Set("If-None-Match", known.ETag)
+	}
+	if known.LastModified != "" {
+		req.Header.Set("If-Modified-Since", known.LastModified)
+	}
+	done, err := s.downloads.acquire(ctx)
+	if err != nil {
+		return fetched{}, err
+	}
+	defer done()
+	release, err := s.hosts.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return fetched{}, err
+	}
+	defer release()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fetched{}, retryableError{err: fmt.Errorf("error downloading %s: %v", url, err)}
+	}
+	defer resp.Body.Close()
+	got := validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		s.infof("    resuming %s at %d bytes", url, offset)
+		flags = os.O_RDWR
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range (or there was none), so start over
+		offset = 0
+	case resp.StatusCode == http.StatusNotModified && known.known():
+		// what we have is current, so a partial newer copy is no use
+		os.Remove(partial)
+		return fetched{}, errNotModified
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is no use to us
+		os.Remove(partial)
+		return fetched{}, retryableError{err: fmt.Errorf("server rejected resuming %s at %d bytes", url, offset)}
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+		// the server wants everyone to back off, not just this download
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = throttledPause
+		}
+		s.warnf("    %s asked us to slow down, pausing downloads for %v", req.URL.Host, wait)
+		s.hosts.pause(wait)
+		return fetched{}, retryableError{err: fmt.Errorf("throttled downloading %s: %d", url, resp.StatusCode)}
+	default:
+		err := fmt.Errorf("unexpected status code downloading %s: %d", url, resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			return fetched{}, retryableError{err: err}
+		}
+		return fetched{}, err
+	}
+
+	// create the directory if necessary
+	if err = s.dirs.mkdirAll(filepath.Dir(fullpath)); err != nil {
+		return fetched{}, err
+	}
+	fp, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return fetched{}, fmt.Errorf("failed to open %s for writing: %v", partial, err)
+	}
+
+	// hash the data as it is written, starting with anything already there
+	h, extra := md5.New(), s.newChecksum()
+	hw := hashWriter(h, extra)
+	if offset, err = io.Copy(hw, fp); err != nil {
+		fp.Close()
+		os.Remove(partial)
+		return fetched{}, fmt.Errorf("error reading %s: %v", partial, err)
+	}
+	var body io.Reader = resp.Body
+	if s.bandwidth != nil {
+		body = &throttledReader{ctx: ctx, r: body, l: s.bandwidth}
+	}
+	n, err := io.Copy(io.MultiWriter(fp, hw), body)
+	size := offset + n
+	if err != nil {
+		fp.Close()
+		return fetched{}, retryableError{err: fmt.Errorf("error saving file %s: %v", partial, err)}
+	}
+
+	// make sure the data is on disk before it takes the place of the real file
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(partial)
+		return fetched{}, fmt.Errorf("error saving file %s: %v", partial, err)
+	}
+	if err = fp.Close(); err != nil {
+		os.Remove(partial)
+		return fetched{}, fmt.Errorf("error saving file %s: %v", partial, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if expect != nil {
+		if int(size) != expect.Size {
+			if int(size) > expect.Size {
+				// too long to be resumed, so start from scratch next time
+				os.Remove(partial)
+			}
+			return fetched{}, retryableError{err: fmt.Errorf("downloaded %d bytes from %s, expected %d", size, url, expect.Size), truncated: true}
+		}
+		if sum != expect.MD5Sum {
+			os.Remove(partial)
+			return fetched{}, retryableError{err: fmt.Errorf("downloaded data from %s has MD5 %s, expected %s", url, sum, expect.MD5Sum)}
+		}
+	}
+
+	if err = renameFile(partial, fullpath); err != nil {
+		os.Remove(partial)
+		return fetched{}, fmt.Errorf("failed to rename %s to %s: %v", partial, fullpath, err)
+	}
+
+	return fetched{size: size, md5: sum, checksum: hashSum(extra), validators: got}, nil
+}
+
+// checkURL makes sure url can be downloaded without fetching it, for a
+// dry run with DryCheck: the server must answer a HEAD request with 200,
+// and if expect is not nil, give its size as the length.
+func (s *albumJob) checkURL(ctx context.Context, url string, expect *smugmug.ImageInfo) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request for %s: %v", url, err)
+	}
+	release, err := s.hosts.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{err: fmt.Errorf("error checking %s: %v", url, err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status code checking %s: %d", url, resp.StatusCode)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return retryableError{err: err}
+		}
+		return err
+	}
+	if expect != nil && resp.ContentLength >= 0 && resp.ContentLength != int64(expect.Size) {
+		return fmt.Errorf("server gives %d bytes for %s, expected %d", resp.ContentLength, url, expect.Size)
+	}
+	return nil
+}
+
+// newClient returns the HTTP client shared by all downloads. Connections
+// are kept alive and reused. A non-zero timeout limits how long it waits to
+// connect and for a response to begin, but not how long a response body
+// may take to arrive, since large videos can legitimately take a while.
+// Requests go through the proxy picked by proxy.
+func newClient(timeout time.Duration, proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// storeCreated records the sums of a file the sync has just put at path,
+// so the next scan need not read it again.
+func (s *Syncer) storeCreated(path, sum, checksum string) {
+	if info, err := os.Stat(filepath.Join(s.Dir, path)); err == nil {
+		s.cache.store(path, info, sum, checksum)
+	}
+}
+
+// knownChecksum returns the extra checksum cached for the file at path,
+// or "" if there is none, so it can follow the file when it is moved.
+func (s *Syncer) knownChecksum(path string) string {
+	info, err := os.Stat(filepath.Join(s.Dir, path))
+	if err != nil {
+		return ""
+	}
+	checksum, _ := s.cache.lookupChecksum(path, info)
+	return checksum
+}
+
+// linkFile replaces fullpath with a hard link to src, provided src is
+// still the expected size.
+func (s *Syncer) linkFile(src, fullpath string, size int) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(size) {
+		return fmt.Errorf("%s has changed", src)
+	}
+	if err = s.dirs.mkdirAll(filepath.Dir(fullpath)); err != nil {
+		return err
+	}
+
+	// link beside the target first so any existing file is replaced in
+	// a single step
+	tmp := fullpath + partialSuffix
+	os.Remove(tmp)
+	if err = os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fullpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// moveFile moves src to fullpath, provided src is still the expected size.
+func (s *Syncer) moveFile(src, fullpath string, size int) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(size) {
+		return fmt.Errorf("%s has changed", src)
+	}
+	if err = s.dirs.mkdirAll(filepath.Dir(fullpath)); err != nil {
+		return err
+	}
+	return renameFile(src, fullpath)
+}
+
+// rename is os.Rename, as renameFile first tries it; tests replace it to
+// make src and dest look like they are on different file systems.
+var rename = os.Rename
+
+// renameFile renames src to dest. If they are on different file systems,
+// src is copied beside dest, renamed into place, and then removed, so
+// dest still never holds a partial file.
+func renameFile(src, dest string) error {
+	err := rename(src, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dest + partialSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chtimes(dest, info.ModTime(), info.ModTime())
+	}
+	return os.Remove(src)
+}
+
+// hashFile returns the hex-encoded MD5 sum of the named file, and its
+// sum with extra too if that is not nil.
+func hashFile(path string, extra hash.Hash) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err = io.Copy(hashWriter(h, extra), f); err != nil {
+		return "", "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), hashSum(extra), nil
+}
+
+// hashWriter returns a writer that feeds both h and extra, or just h if
+// extra is nil.
+func hashWriter(h, extra hash.Hash) io.Writer {
+	if extra == nil {
+		return h
+	}
+	return io.MultiWriter(h, extra)
+}
+
+// hashSum returns the hex-encoded sum of h, or "" if h is nil.
+func hashSum(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// retryableError marks a failure that may succeed if attempted again,
+// such as a dropped connection or a server error. A truncated download is
+// retried once even when retries are turned off, since a short read is
+// almost always transient.
+type retryableError struct {
+	err       error
+	truncated bool
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// withRetry calls fn until it succeeds, returns an error that is not
+// retryable, or has failed more than retries times. It sleeps between
+// attempts, doubling the delay each time, and gives up early if ctx is
+// cancelled.
+func (s *albumJob) withRetry(ctx context.Context, what string, fn func() error) error {
+	return retry(ctx, s.Retries, what, s.warnf, fn)
+}
+
+// withRetry is the same for calls made outside of any album.
+func (s *Syncer) withRetry(ctx context.Context, what string, fn func() error) error {
+	return retry(ctx, s.Retries, what, s.warnf, fn)
+}
+
+// retryDelay is how long retry waits after the first failed attempt. It
+// doubles with each attempt after that.
+var retryDelay = time.Second
+
+// retry does the work of withRetry, logging failed attempts with warnf.
+func retry(ctx context.Context, retries int, what string, warnf func(string, ...interface{}), fn func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r, ok := err.(retryableError)
+		tries := retries
+		if ok && r.truncated && tries < 1 {
+			tries = 1
+		}
+		if !ok || attempt > tries {
+			return err
+		}
+		warnf("    %s: attempt %d of %d failed, retrying in %v: %v", what, attempt, tries+1, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,777 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+func TestRenameFileAcrossFileSystems(t *testing.T) {
+	rename = func(src, dest string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+	}
+	defer func() { rename = os.Rename }()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.jpg")
+	dest := filepath.Join(dir, "dest.jpg")
+	writeFile(t, dir, "src.jpg", "picture")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := renameFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil || string(data) != "picture" {
+		t.Errorf("dest holds %q, %v; want the contents of src", data, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("src was not removed: %v", err)
+	}
+	if _, err := os.Stat(dest + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("the partial copy was left behind: %v", err)
+	}
+	if info, err := os.Stat(dest); err == nil && !info.ModTime().Equal(mtime) {
+		t.Errorf("dest modified at %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestRenameFileOtherErrors(t *testing.T) {
+	dir := t.TempDir()
+	err := renameFile(filepath.Join(dir, "missing.jpg"), filepath.Join(dir, "dest.jpg"))
+	if !os.IsNotExist(err) {
+		t.Errorf("renameFile of a missing file = %v, want a not-exist error", err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	const content = "the new version of the file"
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "a.jpg", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	s := newTestSyncer(t)
+	job := s.newJob()
+	fullpath := filepath.Join(s.Dir, "a.jpg")
+	sum := md5.Sum([]byte(content))
+	expect := &smugmug.ImageInfo{Size: len(content), MD5Sum: hex.EncodeToString(sum[:])}
+
+	// an original is checked afterwards, so it can be resumed
+	writeFile(t, s.Dir, "a.jpg"+partialSuffix, content[:8])
+	got, err := job.download(context.Background(), server.URL, fullpath, expect, validators{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.md5 != expect.MD5Sum || ranges[0] != "bytes=8-" {
+		t.Errorf("resumed download = %s with range %q, want %s with bytes=8-", got.md5, ranges[0], expect.MD5Sum)
+	}
+
+	// a video or resized copy cannot be, so a partial left from an
+	// older version is thrown away
+	writeFile(t, s.Dir, "a.jpg"+partialSuffix, "the old version")
+	if _, err := job.download(context.Background(), server.URL, fullpath, nil, validators{}); err != nil {
+		t.Fatal(err)
+	}
+	if ranges[1] != "" {
+		t.Errorf("unverifiable download sent range %q, want none", ranges[1])
+	}
+	if data, err := os.ReadFile(fullpath); err != nil || string(data) != content {
+		t.Errorf("downloaded %q, %v; want %q", data, err, content)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  string
+		want bool
+	}{
+		{"connection reset by peer", true},
+		{"503 service unavailable", true},
+		{"invalid session", true},
+		{"Invalid login", false},
+		{"invalid API key", false},
+		{"wrong password", false},
+		{"permission denied", false},
+		{"Album not found", false},
+	}
+	for _, tt := range tests {
+		_, got := retryable(errors.New(tt.err)).(retryableError)
+		if got != tt.want {
+			t.Errorf("retryable(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+	if err := retryable(nil); err != nil {
+		t.Errorf("retryable(nil) = %v, want nil", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	old := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = old }()
+
+	permanent := errors.New("not found")
+	transient := retryableError{err: errors.New("connection reset")}
+	truncated := retryableError{err: errors.New("short read"), truncated: true}
+	tests := []struct {
+		name    string
+		retries int
+		errs    []error // returned by successive attempts, then nil
+		calls   int
+		want    error
+		delays  []string
+	}{
+		{"success", 3, nil, 1, nil, nil},
+		{"permanent", 3, []error{permanent}, 1, permanent, nil},
+		{"recovers", 3, []error{transient, transient}, 3, nil, []string{"1ms", "2ms"}},
+		{"gives up", 2, []error{transient, transient, transient, transient}, 3, transient, []string{"1ms", "2ms"}},
+		{"no retries", 0, []error{transient}, 1, transient, nil},
+		{"truncated without retries", 0, []error{truncated}, 2, nil, []string{"1ms"}},
+		{"truncated twice without retries", 0, []error{truncated, truncated}, 2, truncated, []string{"1ms"}},
+	}
+	for _, tt := range tests {
+		calls := 0
+		var delays []string
+		warnf := func(format string, v ...interface{}) {
+			delays = append(delays, fmt.Sprint(v[3]))
+		}
+		err := retry(context.Background(), tt.retries, "a.jpg", warnf, func() error {
+			calls++
+			if calls <= len(tt.errs) {
+				return tt.errs[calls-1]
+			}
+			return nil
+		})
+		if err != tt.want || calls != tt.calls {
+			t.Errorf("%s: retry = %v after %d calls, want %v after %d", tt.name, err, calls, tt.want, tt.calls)
+		}
+		if fmt.Sprint(delays) != fmt.Sprint(tt.delays) {
+			t.Errorf("%s: waited %v, want %v", tt.name, delays, tt.delays)
+		}
+	}
+
+	// a cancelled run does not retry
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := retry(ctx, 3, "a.jpg", t.Logf, func() error {
+		calls++
+		cancel()
+		return transient
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("retry after cancelling = %v after %d calls, want %v after 1", err, calls, context.Canceled)
+	}
+}
+
+func TestDownloadStatusRetryable(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		want       bool
+	}{
+		{http.StatusInternalServerError, "", true},
+		{http.StatusBadGateway, "", true},
+		{http.StatusServiceUnavailable, "", true},
+		{http.StatusServiceUnavailable, "0", true},
+		{http.StatusTooManyRequests, "0", true},
+		{http.StatusRequestedRangeNotSatisfiable, "", true},
+		{http.StatusNotFound, "", false},
+		{http.StatusForbidden, "", false},
+		{http.StatusNotModified, "", false},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		s := newTestSyncer(t)
+		_, err := s.newJob().download(context.Background(), server.URL, filepath.Join(s.Dir, "a.jpg"), nil, validators{})
+		server.Close()
+		if err == nil {
+			t.Errorf("download with status %d succeeded", tt.status)
+			continue
+		}
+		if _, got := err.(retryableError); got != tt.want {
+			t.Errorf("download with status %d (Retry-After %q) retryable = %v, want %v: %v",
+				tt.status, tt.retryAfter, got, tt.want, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512b", 512, true},
+		{"500k", 500 * 1024, true},
+		{"2MB", 2 * 1024 * 1024, true},
+		{" 1.5g ", 3 * 512 * 1024 * 1024, true},
+		{"1Gb", 1024 * 1024 * 1024, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"-1m", 0, false},
+		{"fast", 0, false},
+		{"2 mb", 0, false},
+		{"1tb", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{12, "12 bytes"},
+		{1024, "1024 bytes"},
+		{20 * 1024, "20.0k"},
+		{3 * 512 * 1024, "1.5m"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.in); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	// 100k at 1m a second is spread over about 100ms, however the reads
+	// are split between goroutines
+	l := newLimiter(1000 * 1000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.wait(context.Background(), 20*1000); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took < 90*time.Millisecond || took > time.Second {
+		t.Errorf("waiting for 100k at 1m a second took %v, want about 100ms", took)
+	}
+
+	// time not used is not saved up for later
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	if err := l.wait(context.Background(), 20*1000); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 15*time.Millisecond {
+		t.Errorf("waiting after an idle spell took %v, want about 20ms", took)
+	}
+
+	// a cancelled wait gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1000*1000); err != context.Canceled {
+		t.Errorf("cancelled wait = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	content := strings.Repeat("x", 100*1024)
+	r := &throttledReader{ctx: context.Background(), r: strings.NewReader(content), l: newLimiter(1 << 30)}
+	buf := make([]byte, len(content))
+	n, err := r.Read(buf)
+	if err != nil || n != 32*1024 {
+		t.Errorf("read %d bytes, %v; want reads capped at 32k", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = &throttledReader{ctx: ctx, r: strings.NewReader(content), l: newLimiter(1)}
+	if n, err := r.Read(buf); n == 0 || err != context.Canceled {
+		t.Errorf("read after cancelling = %d bytes, %v; want the bytes read and %v", n, err, context.Canceled)
+	}
+}
+
+// exifJPEG returns the start of a JPEG whose EXIF data holds the given
+// DateTimeOriginal and DateTime, leaving out any that are "".
+func exifJPEG(order binary.ByteOrder, original, datetime string) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+
+	// IFD0, the EXIF IFD, and then the strings they point to
+	n0, dl := 0, 0
+	if datetime != "" {
+		n0, dl = n0+1, len(datetime)+1
+	}
+	if original != "" {
+		n0++
+	}
+	sub := uint32(8 + 2 + 12*n0 + 4)
+	strs := sub
+	if original != "" {
+		strs += 2 + 12 + 4
+	}
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(&tiff, order, tag)
+		binary.Write(&tiff, order, typ)
+		binary.Write(&tiff, order, count)
+		binary.Write(&tiff, order, value)
+	}
+	binary.Write(&tiff, order, uint16(n0))
+	if datetime != "" {
+		entry(exifDateTime, exifTypeASCII, uint32(dl), strs)
+	}
+	if original != "" {
+		entry(exifIFDPointer, exifTypeLong, 1, sub)
+	}
+	binary.Write(&tiff, order, uint32(0))
+	if original != "" {
+		binary.Write(&tiff, order, uint16(1))
+		entry(exifDateTimeOrig, exifTypeASCII, uint32(len(original)+1), strs+uint32(dl))
+		binary.Write(&tiff, order, uint32(0))
+	}
+	if datetime != "" {
+		tiff.WriteString(datetime + "\x00")
+	}
+	if original != "" {
+		tiff.WriteString(original + "\x00")
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(2+6+tiff.Len()))
+	b.WriteString("Exif\x00\x00")
+	b.Write(tiff.Bytes())
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x02})
+	return b.Bytes()
+}
+
+func TestExifTime(t *testing.T) {
+	taken := time.Date(2019, 7, 4, 12, 30, 15, 0, time.Local)
+	changed := time.Date(2021, 1, 2, 3, 4, 5, 0, time.Local)
+	both := exifJPEG(binary.LittleEndian, "2019:07:04 12:30:15", "2021:01:02 03:04:05")
+	// a segment length that promises more than the file holds
+	long := append([]byte(nil), both...)
+	binary.BigEndian.PutUint16(long[4:], uint16(len(both)))
+	// a segment that ends before the strings the entries point to
+	short := append([]byte(nil), both...)
+	binary.BigEndian.PutUint16(short[4:], uint16(2+6+40))
+
+	tests := []struct {
+		name string
+		data []byte
+		want time.Time
+		ok   bool
+	}{
+		{"original and changed", both, taken, true},
+		{"big endian", exifJPEG(binary.BigEndian, "2019:07:04 12:30:15", ""), taken, true},
+		{"only changed", exifJPEG(binary.BigEndian, "", "2021:01:02 03:04:05"), changed, true},
+		{"bad original", exifJPEG(binary.LittleEndian, "yesterday at noon", "2021:01:02 03:04:05"), changed, true},
+		{"bad dates", exifJPEG(binary.LittleEndian, "", "2021-01-02T03:04:05Z"), time.Time{}, false},
+		{"no dates", exifJPEG(binary.LittleEndian, "", ""), time.Time{}, false},
+		{"no exif", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 'J', 'F', 0xFF, 0xDA, 0x00, 0x02}, time.Time{}, false},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), time.Time{}, false},
+		{"empty", nil, time.Time{}, false},
+		{"cut off in the tiff header", both[:16], time.Time{}, false},
+		{"cut off in the strings", both[:len(both)-12], time.Time{}, false},
+		{"segment longer than the file", long, time.Time{}, false},
+		{"segment shorter than its entries", short, time.Time{}, false},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "a.jpg")
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := exifTime(path)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("%s: exifTime = %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := exifTime(filepath.Join(dir, "missing.jpg")); ok {
+		t.Errorf("exifTime of a missing file found a time")
+	}
+}
+
+func TestCaptureTime(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "exif.jpg", string(exifJPEG(binary.LittleEndian, "2019:07:04 12:30:15", "")))
+	writeFile(t, dir, "plain.jpg", "not really a picture")
+	taken := time.Date(2019, 7, 4, 12, 30, 15, 0, time.Local)
+	uploaded := time.Date(2020, 5, 6, 7, 8, 9, 0, time.Local)
+
+	tests := []struct {
+		file, format, date string
+		want               time.Time
+		ok                 bool
+	}{
+		{"exif.jpg", "JPG", "2020-05-06 07:08:09", taken, true},
+		{"exif.jpg", "PNG", "2020-05-06 07:08:09", uploaded, true},
+		{"plain.jpg", "JPG", "2020-05-06 07:08:09", uploaded, true},
+		{"plain.jpg", "JPG", "", time.Time{}, false},
+		{"plain.jpg", "JPG", "last summer", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		image := &smugmug.ImageInfo{Format: tt.format, Date: tt.date}
+		got, ok := captureTime(filepath.Join(dir, tt.file), image)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("captureTime(%s, %s, %q) = %v, %v; want %v, %v", tt.file, tt.format, tt.date, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"0", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+		{"Fri, 32 Mar 2024 12:00:00 GMT", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestThrottledDownloadPauses(t *testing.T) {
+	tests := []struct {
+		retryAfter string
+		want       time.Duration
+	}{
+		{"2", 2 * time.Second},
+		{"", throttledPause},
+		{"whenever", throttledPause},
+		{"-1", throttledPause},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		s := newTestSyncer(t)
+		start := time.Now()
+		_, err := s.newJob().download(context.Background(), server.URL, filepath.Join(s.Dir, "a.jpg"), nil, validators{})
+		server.Close()
+		if _, ok := err.(retryableError); !ok {
+			t.Errorf("Retry-After %q: download = %v, want a retryable error", tt.retryAfter, err)
+		}
+		if got := s.hosts.until.Sub(start); got < tt.want || got > tt.want+time.Second {
+			t.Errorf("Retry-After %q: paused for %v, want %v", tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	h := newHostLimiter(1)
+	release, err := h.acquire(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host is busy, but others are not
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.acquire(ctx, "a.example.com"); err != context.DeadlineExceeded {
+		t.Errorf("second request to a busy host = %v, want %v", err, context.DeadlineExceeded)
+	}
+	other, err := h.acquire(context.Background(), "b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+	release()
+	if release, err = h.acquire(context.Background(), "a.example.com"); err != nil {
+		t.Fatalf("request after the first finished = %v", err)
+	}
+	release()
+
+	// a pause holds up every host, and a shorter one does not cut it short
+	h.pause(50 * time.Millisecond)
+	h.pause(time.Millisecond)
+	start := time.Now()
+	if release, err = h.acquire(context.Background(), "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if took := time.Since(start); took < 40*time.Millisecond {
+		t.Errorf("request during a pause started after %v, want about 50ms", took)
+	}
+	h.pause(time.Minute)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.acquire(ctx, "a.example.com"); err != context.Canceled {
+		t.Errorf("cancelled request during a pause = %v, want %v", err, context.Canceled)
+	}
+
+	// with no limit, requests only wait for pauses
+	h = newHostLimiter(0)
+	for i := 0; i < 3; i++ {
+		if _, err := h.acquire(context.Background(), "a.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDownloadValidators(t *testing.T) {
+	const content = "the current version of the file"
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "a.jpg", modified, strings.NewReader(content))
+	}))
+	defer server.Close()
+	sum := md5.Sum([]byte(content))
+	original := &smugmug.ImageInfo{Size: len(content), MD5Sum: hex.EncodeToString(sum[:])}
+
+	tests := []struct {
+		name    string
+		partial string
+		expect  *smugmug.ImageInfo
+		known   validators
+		want    error // from download, or nil for the whole file
+		rng     string
+	}{
+		{"matching etag", "", nil, validators{ETag: `"v2"`}, errNotModified, ""},
+		{"mismatched etag", "", nil, validators{ETag: `"v1"`}, nil, ""},
+		{"matching date", "", nil, validators{LastModified: modified.Format(http.TimeFormat)}, errNotModified, ""},
+		{"older date", "", nil, validators{LastModified: modified.Add(-time.Hour).Format(http.TimeFormat)}, nil, ""},
+		{"current partial, mismatched etag", content[:8], original, validators{ETag: `"v1"`}, nil, "bytes=8-"},
+		{"partial of the current version", content[:8], nil, validators{ETag: `"v2"`}, errNotModified, ""},
+		{"stale partial", "OLD DATA", original, validators{}, retryableError{}, "bytes=8-"},
+	}
+	for _, tt := range tests {
+		s := newTestSyncer(t)
+		fullpath := filepath.Join(s.Dir, "a.jpg")
+		if tt.partial != "" {
+			writeFile(t, s.Dir, "a.jpg"+partialSuffix, tt.partial)
+		}
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+		got, err := s.newJob().download(context.Background(), server.URL, fullpath, tt.expect, tt.known)
+		switch tt.want.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: download = %v, want the file", tt.name, err)
+				continue
+			}
+			if data, _ := os.ReadFile(fullpath); string(data) != content || got.ETag != `"v2"` {
+				t.Errorf("%s: downloaded %q with etag %s, want %q with \"v2\"", tt.name, data, got.ETag, content)
+			}
+		case retryableError:
+			if _, ok := err.(retryableError); !ok {
+				t.Errorf("%s: download = %v, want a retryable error", tt.name, err)
+			}
+		default:
+			if err != tt.want {
+				t.Errorf("%s: download = %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		if tt.want != nil {
+			if _, err := os.Stat(fullpath); !os.IsNotExist(err) {
+				t.Errorf("%s: a file was saved: %v", tt.name, err)
+			}
+			if _, err := os.Stat(fullpath + partialSuffix); !os.IsNotExist(err) {
+				t.Errorf("%s: the partial file was kept: %v", tt.name, err)
+			}
+		}
+		mu.Lock()
+		r := requests[0]
+		mu.Unlock()
+		if r.Header.Get("Range") != tt.rng || r.Header.Get("If-None-Match") != tt.known.ETag ||
+			r.Header.Get("If-Modified-Since") != tt.known.LastModified {
+			t.Errorf("%s: sent range %q, If-None-Match %q, If-Modified-Since %q; want %q, %q, %q", tt.name,
+				r.Header.Get("Range"), r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"),
+				tt.rng, tt.known.ETag, tt.known.LastModified)
+		}
+	}
+}
+
+func TestCachedValidators(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.mp4", "video")
+	info, err := os.Stat(filepath.Join(dir, "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &md5Cache{entries: make(map[string]cacheEntry)}
+	v := validators{ETag: `"v1"`, LastModified: "Fri, 01 Mar 2024 12:00:00 GMT"}
+	c.storeDownload("a.mp4", info, "md5sum", "", v)
+	if got, ok := c.lookupValidators("a.mp4", info); !ok || got != v {
+		t.Errorf("lookupValidators = %+v, %v; want %+v", got, ok, v)
+	}
+
+	// hashing the file again keeps them
+	c.store("a.mp4", info, "md5sum", "")
+	if got, ok := c.lookupValidators("a.mp4", info); !ok || got != v {
+		t.Errorf("lookupValidators after hashing = %+v, %v; want %+v", got, ok, v)
+	}
+
+	// but a file changed since is not the copy they were for
+	writeFile(t, dir, "a.mp4", "edited video")
+	changed, err := os.Stat(filepath.Join(dir, "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.lookupValidators("a.mp4", changed); ok {
+		t.Errorf("lookupValidators of a changed file = %+v, want none", got)
+	}
+	c.store("a.mp4", changed, "othersum", "")
+	if got, ok := c.lookupValidators("a.mp4", changed); ok {
+		t.Errorf("lookupValidators after hashing a changed file = %+v, want none", got)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	const serverCopy = "the server's copy"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, serverCopy)
+	}))
+	defer server.Close()
+	sum := md5.Sum([]byte(serverCopy))
+	updated := time.Now().Add(-2 * time.Hour)
+
+	tests := []struct {
+		name       string
+		onConflict string
+		edited     time.Time // when the local copy was last changed
+		undated    bool      // the server gives no date for the image
+		want       string    // what is left on disk
+		status     string
+		conflicts  int
+	}{
+		{"replaced", "server", time.Now(), false, serverCopy, "changed", 1},
+		{"skipped", "skip", time.Now(), false, "local edit", "conflict", 1},
+		{"kept", "local", time.Now(), false, "local edit", "conflict", 1},
+		{"older than the server's", "skip", updated.Add(-time.Hour), false, serverCopy, "changed", 0},
+		{"no server date", "skip", time.Now(), true, serverCopy, "changed", 0},
+	}
+	for _, tt := range tests {
+		s := newTestSyncer(t)
+		s.OnConflict = tt.onConflict
+		album := testAlbum("Trip")
+		image := &smugmug.ImageInfo{Key: "a", FileName: "a.jpg", Format: "JPG", Size: len(serverCopy),
+			MD5Sum: hex.EncodeToString(sum[:]), OriginalURL: server.URL}
+		if !tt.undated {
+			image.LastUpdated = updated.Format("2006-01-02 15:04:05")
+		}
+		path := filepath.Join("Other", "Trip", "a.jpg")
+		writeFile(t, s.Dir, path, "local edit")
+		if err := os.Chtimes(filepath.Join(s.Dir, path), tt.edited, tt.edited); err != nil {
+			t.Fatal(err)
+		}
+		localFiles := newFileSet(false)
+		localSum := md5.Sum([]byte("local edit"))
+		localFiles.set(path, hex.EncodeToString(localSum[:]))
+
+		if err := s.newJob().syncFile(context.Background(), album, image, localFiles); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if data, _ := os.ReadFile(filepath.Join(s.Dir, path)); string(data) != tt.want {
+			t.Errorf("%s: left %q, want %q", tt.name, data, tt.want)
+		}
+		files := append(s.result.Changed, s.result.Skipped...)
+		if len(files) != 1 || files[0].Status != tt.status {
+			t.Errorf("%s: recorded %+v, want one file with status %s", tt.name, files, tt.status)
+		}
+		if got := s.Stats().Conflicts; got != tt.conflicts {
+			t.Errorf("%s: counted %d conflicts, want %d", tt.name, got, tt.conflicts)
+		}
+	}
+}
+
+func TestLocalStatus(t *testing.T) {
+	s := newTestSyncer(t)
+	updated := time.Now().Add(-2 * time.Hour).Format("2006-01-02 15:04:05")
+	writeFile(t, s.Dir, "edited.jpg", "local edit")
+	writeFile(t, s.Dir, "old.jpg", "old copy")
+	old := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(filepath.Join(s.Dir, "old.jpg"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	known := validators{ETag: `"v1"`}
+
+	tests := []struct {
+		path, format, size, local string
+		known                     validators
+		want                      string
+	}{
+		{"new.jpg", "JPG", "original", "", validators{}, "new"},
+		{"old.jpg", "JPG", "original", "servermd5", validators{}, "unchanged"},
+		{"old.jpg", "JPG", "original", "othermd5", validators{}, "changed"},
+		{"edited.jpg", "JPG", "original", "othermd5", validators{}, "conflict"},
+		{"old.mp4", "MP4", "original", "othermd5", validators{}, "unchanged"},
+		{"old.mp4", "MP4", "original", "othermd5", known, "changed"},
+		{"old.jpg", "JPG", "large", "othermd5", validators{}, "unchanged"},
+		{"old.jpg", "JPG", "large", "othermd5", known, "changed"},
+		{"edited.jpg", "JPG", "large", "othermd5", known, "conflict"},
+	}
+	for _, tt := range tests {
+		s.Size = tt.size
+		image := &smugmug.ImageInfo{Format: tt.format, MD5Sum: "servermd5", LastUpdated: updated}
+		if got := s.localStatus(image, tt.path, tt.local, tt.known); got != tt.want {
+			t.Errorf("localStatus(%s %s, size %s, local %q, %+v) = %s, want %s",
+				tt.format, tt.path, tt.size, tt.local, tt.known, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package syncer
+
+import (
+	"time"
+)
+
+// Event describes something a run has just done, for callers following
+// along as it happens. Type is one of scan_started, album_started,
+// file_downloaded, file_skipped, file_failed, file_deleted, error, and
+// summary; the other fields are filled in as they apply.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Account string    `json:"account,omitempty"`
+	Album   string    `json:"album,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Seconds float64   `json:"seconds,omitempty"` // time taken to download
+	Status  string    `json:"status,omitempty"`  // as in the manifest
+	Error   string    `json:"error,omitempty"`
+	Stats   *Stats    `json:"stats,omitempty"`
+}
+
+// emit sends e to the Events callback, if there is one. Events are sent
+// one at a time even when several albums are being synced.
+func (s *Syncer) emit(e Event) {
+	if s.Events == nil {
+		return
+	}
+	e.Time = time.Now()
+	if e.Account == "" {
+		e.Account = s.accountName
+	}
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	s.Events(e)
+}
+
+// fileEvent returns the event for a file handled by syncFile.
+func fileEvent(f File) Event {
+	e := Event{
+		Type:    "file_skipped",
+		Account: f.Account,
+		Album:   f.Album,
+		Path:    f.Path,
+		Size:    f.Size,
+		Status:  f.Status,
+	}
+	switch f.Status {
+	case "new", "changed", "moved", "linked":
+		e.Type = "file_downloaded"
+		e.Seconds = f.Duration.Seconds()
+	case "failed":
+		e.Type = "file_failed"
+		if f.Err != nil {
+			e.Error = f.Err.Error()
+		}
+	}
+	return e
+}
@@ -0,0 +1,134 @@
+package syncer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	exifIFDPointer      = 0x8769
+	exifDateTimeOrig    = 0x9003
+	exifDateTime        = 0x0132
+	exifTypeASCII       = 2
+	exifTypeLong        = 4
+	exifDateTimeFormat  = "2006:01:02 15:04:05"
+	exifMaxHeaderLength = 128 * 1024
+)
+
+// exifTime returns the time a JPEG was taken according to its EXIF data,
+// preferring DateTimeOriginal and falling back to DateTime. EXIF times
+// carry no zone, so they are read as local time.
+func exifTime(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	// the EXIF segment has to come near the start of the file
+	buf := make([]byte, exifMaxHeaderLength)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return time.Time{}, false
+	}
+	tiff := findExif(buf[:n])
+	if tiff == nil {
+		return time.Time{}, false
+	}
+	return parseExifTime(tiff)
+}
+
+// findExif walks the JPEG segments in data and returns the TIFF structure
+// inside the EXIF APP1 segment, if there is one.
+func findExif(data []byte) []byte {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// start of image data or end of image
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		start, end := i+4, i+2+length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[start:end], []byte("Exif\x00\x00")) {
+			return data[start+6 : end]
+		}
+		i = end
+	}
+	return nil
+}
+
+// parseExifTime pulls the capture time out of a TIFF structure.
+func parseExifTime(tiff []byte) (time.Time, bool) {
+	if len(tiff) < 8 {
+		return time.Time{}, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, false
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if e, ok := ifd0[exifIFDPointer]; ok && e.typ == exifTypeLong {
+		sub := readIFD(tiff, order, e.value)
+		if t, ok := exifString(tiff, sub[exifDateTimeOrig]); ok {
+			return t, true
+		}
+	}
+	return exifString(tiff, ifd0[exifDateTime])
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value uint32 // the value itself, or the offset to it
+}
+
+// readIFD returns the entries of the image file directory at offset.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	p := int(offset) + 2
+	for i := 0; i < count && p+12 <= len(tiff); i, p = i+1, p+12 {
+		entries[order.Uint16(tiff[p:])] = ifdEntry{
+			typ:   order.Uint16(tiff[p+2:]),
+			count: order.Uint32(tiff[p+4:]),
+			value: order.Uint32(tiff[p+8:]),
+		}
+	}
+	return entries
+}
+
+// exifString parses a date stored in an ASCII entry.
+func exifString(tiff []byte, e ifdEntry) (time.Time, bool) {
+	// dates are 20 bytes, so they never fit inline
+	if e.typ != exifTypeASCII || e.count <= 4 || uint64(e.value)+uint64(e.count) > uint64(len(tiff)) {
+		return time.Time{}, false
+	}
+	s := strings.TrimRight(string(tiff[e.value:e.value+e.count]), "\x00 ")
+	t, err := time.ParseInLocation(exifDateTimeFormat, s, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
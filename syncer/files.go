@@ -0,0 +1,380 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// fileSet holds what a scan found on disk: paths relative to the target
+// directory mapped to MD5 sums, or "directory" for directories. Entries
+// are removed as the matching images are found on the server, so whatever
+// is left at the end is extra. It is safe for concurrent use, since in the
+// flat layout every album shares one set.
+//
+// On a case-insensitive file system the set can fold case, so that a file
+// whose name differs from the server's only in case is still found.
+// Entries keep the name they were found under.
+type fileSet struct {
+	sync.Mutex
+	files map[string]string
+	fold  bool
+	names map[string]string // folded path to path, when folding
+}
+
+func newFileSet(fold bool) *fileSet {
+	return &fileSet{files: make(map[string]string), fold: fold, names: make(map[string]string)}
+}
+
+// key returns the map key for path.
+func (f *fileSet) key(path string) string {
+	if f.fold {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// get returns the MD5 sum of the file at path, or "" if there is none.
+func (f *fileSet) get(path string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.files[f.key(path)]
+}
+
+func (f *fileSet) set(path, sum string) {
+	f.Lock()
+	defer f.Unlock()
+	k := f.key(path)
+	f.files[k] = sum
+	if f.fold {
+		f.names[k] = path
+	}
+}
+
+// remove drops path from the set.
+func (f *fileSet) remove(path string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.files, f.key(path))
+}
+
+// keep marks a local file, and the directories holding it, as existing on
+// the server so that cleanup leaves them alone.
+func (f *fileSet) keep(path string) {
+	f.Lock()
+	defer f.Unlock()
+	for p := path; p != "." && p != "" && p != string(filepath.Separator); p = filepath.Dir(p) {
+		delete(f.files, f.key(p))
+	}
+}
+
+// entries returns a copy of what is in the set.
+func (f *fileSet) entries() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	m := make(map[string]string, len(f.files))
+	for k, v := range f.files {
+		if f.fold {
+			k = f.names[k]
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// caseInsensitive reports whether dir is on a file system that ignores
+// case in file names, by looking for one of its entries under another
+// case. If none of them has letters and write is set, it creates a file
+// there to look for instead. It returns false if there is nothing to look
+// for, such as when dir does not exist yet.
+func caseInsensitive(dir string, write bool) bool {
+	d, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+	for {
+		entries, err := d.ReadDir(100)
+		for _, e := range entries {
+			if swapped := swapCase(e.Name()); swapped != e.Name() {
+				return sameFile(filepath.Join(dir, e.Name()), filepath.Join(dir, swapped))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !write {
+		return false
+	}
+	f, err := os.CreateTemp(dir, ".smugsync-case-")
+	if err != nil {
+		return false
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	return sameFile(name, filepath.Join(dir, swapCase(filepath.Base(name))))
+}
+
+// sameFile reports whether both paths name the same existing file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// swapCase turns upper case letters in name to lower case and the rest
+// to upper case.
+func swapCase(name string) string {
+	return strings.Map(func(r rune) rune {
+		if u := unicode.ToUpper(r); u != r {
+			return u
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// count returns the number of files (not directories) in the set.
+func (f *fileSet) count() int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, v := range f.files {
+		if v != "directory" {
+			n++
+		}
+	}
+	return n
+}
+
+// scan adds the files and directories under root to localFiles along with
+// their MD5 sums. If recursive is false, only the files directly inside
+// root are included. With --download-only nothing is scanned.
+func (s *albumJob) scan(ctx context.Context, root string, recursive bool, localFiles *fileSet) error {
+	return s.walkFiles(ctx, root, recursive, localFiles, s.warnf)
+}
+
+// scan is the same for scans made outside of any album.
+func (s *Syncer) scan(ctx context.Context, root string, recursive bool, localFiles *fileSet) error {
+	return s.walkFiles(ctx, root, recursive, localFiles, s.warnf)
+}
+
+// walkFiles does the work of scan, logging files it cannot read with
+// warnf. Cancelling ctx stops it while it waits for a scan worker.
+func (s *Syncer) walkFiles(ctx context.Context, root string, recursive bool, localFiles *fileSet, warnf func(string, ...interface{})) error {
+	if s.DownloadOnly {
+		return nil
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil
+	}
+	rel, _ := filepath.Rel(s.Dir, root)
+	s.emit(Event{Type: "scan_started", Path: rel})
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failed   error
+		warnings []string // from the hashing goroutines, logged at the end
+	)
+	// directories are only marked as scanned once the walk has finished
+	// without an error
+	type dirInfo struct {
+		path string
+		info os.FileInfo
+	}
+	var scannedDirs []dirInfo
+	var walk filepath.WalkFunc
+	walk = func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		suffix := path
+		if strings.HasPrefix(path, s.Dir+"/") {
+			suffix = path[len(s.Dir)+1:]
+		}
+
+		// junk the OS leaves behind is not ours to sync or delete
+		if path != root && s.ignored(suffix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if path == root {
+				if root != s.Dir {
+					localFiles.set(suffix, "directory")
+				}
+			} else {
+				if !recursive || (s.trash != "" && path == filepath.Dir(s.trash)) {
+					return filepath.SkipDir
+				}
+				localFiles.set(suffix, "directory")
+			}
+			if !s.TrustDirs {
+				return nil
+			}
+
+			// a directory whose modification time is the same as at the
+			// last full scan has had nothing added, removed, or renamed,
+			// so its files are taken from the cache without being looked
+			// at, and only its subdirectories are walked; if the cache
+			// lacks a usable sum for any of them it is scanned in full
+			key := suffix
+			if path == s.Dir {
+				key = "."
+			}
+			var files, dirs []string
+			ok := s.cache.unchangedDir(key, info)
+			if ok {
+				files, dirs, ok = s.cache.children(key)
+			}
+			if !ok {
+				scannedDirs = append(scannedDirs, dirInfo{key, info})
+				return nil
+			}
+			for _, k := range files {
+				if !s.ignored(k) {
+					sum, _ := s.cache.lookupSum(k)
+					s.addScanned(filepath.Join(s.Dir, k), k, sum, localFiles)
+				}
+			}
+			if path == root && !recursive {
+				return filepath.SkipDir
+			}
+			for _, k := range dirs {
+				err := filepath.Walk(filepath.Join(s.Dir, k), walk)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return filepath.SkipDir
+		}
+
+		// partial downloads are resumed, not treated as local files
+		if strings.HasSuffix(path, partialSuffix) || path == s.cacheFile {
+			return nil
+		}
+
+		// get an MD5 hash, reusing the last one if the file looks the same
+		if sum, ok := s.cache.lookup(suffix, info); ok {
+			s.addScanned(path, suffix, sum, localFiles)
+			return nil
+		}
+		if s.hashing == nil {
+			return s.hashScanned(path, suffix, info, localFiles, warnf)
+		}
+
+		// with a pool of scan workers the files are hashed while the walk
+		// goes on, and the first failure stops it
+		mu.Lock()
+		err = failed
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		release, err := s.hashing.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		// warnf may be a job's, which is not safe to call from several
+		// goroutines, so their warnings are collected instead
+		collect := func(format string, v ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, fmt.Sprintf(format, v...))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			if err := s.hashScanned(path, suffix, info, localFiles, collect); err != nil {
+				mu.Lock()
+				if failed == nil {
+					failed = err
+				}
+				mu.Unlock()
+			}
+		}()
+		return nil
+	}
+	err := filepath.Walk(root, walk)
+	wg.Wait()
+	for _, w := range warnings {
+		warnf("%s", w)
+	}
+	if err == nil {
+		err = failed
+	}
+	if err == nil {
+		for _, d := range scannedDirs {
+			s.cache.storeDir(d.path, d.info)
+		}
+	}
+	return err
+}
+
+// hashScanned hashes a file found by the scan and adds it.
+func (s *Syncer) hashScanned(path, suffix string, info os.FileInfo, localFiles *fileSet, warnf func(string, ...interface{})) error {
+	sum, checksum, err := hashFile(path, s.newChecksum())
+	if err != nil {
+		warnf("%v", err)
+		return err
+	}
+	s.cache.store(suffix, info, sum, checksum)
+	s.addScanned(path, suffix, sum, localFiles)
+	return nil
+}
+
+// addScanned adds a file found by the scan with its MD5 sum.
+func (s *Syncer) addScanned(path, suffix, sum string, localFiles *fileSet) {
+	if s.Hardlink {
+		s.saved.add(sum, path)
+	}
+	localFiles.set(suffix, sum)
+}
+
+// dirCache remembers the directories that are known to exist, so that
+// downloading an album of hundreds of images into one directory creates
+// it once rather than once per file. It is safe for concurrent use.
+type dirCache struct {
+	sync.Mutex
+	made map[string]bool
+}
+
+// mkdirAll creates dir and any missing parents, unless it has already
+// been made.
+func (d *dirCache) mkdirAll(dir string) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.made[dir] {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	d.made[dir] = true
+	return nil
+}
+
+// forget drops dir, which has been removed, and everything under it, so
+// they are made again if need be.
+func (d *dirCache) forget(dir string) {
+	d.Lock()
+	defer d.Unlock()
+	for k := range d.made {
+		if k == dir || strings.HasPrefix(k, dir+string(filepath.Separator)) {
+			delete(d.made, k)
+		}
+	}
+}
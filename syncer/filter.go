@@ -0,0 +1,117 @@
+package syncer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/russross/smugmug"
+)
+
+// Patterns is a flag.Value holding glob patterns. The flag may be given
+// more than once, and each value may hold several comma-separated patterns.
+type Patterns []string
+
+func (p *Patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *Patterns) Set(value string) error {
+	for _, pat := range strings.Split(value, ",") {
+		pat = strings.TrimSpace(pat)
+		if pat == "" {
+			continue
+		}
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %v", pat, err)
+		}
+		*p = append(*p, pat)
+	}
+	return nil
+}
+
+// match reports whether name matches any of the patterns, ignoring case.
+func (p Patterns) match(name string) bool {
+	name = strings.ToLower(name)
+	for _, pat := range p {
+		if ok, _ := filepath.Match(strings.ToLower(pat), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filteringAlbums reports whether any album filters are set.
+func (s *Syncer) filteringAlbums() bool {
+	return len(s.Albums) > 0 || len(s.Categories) > 0 || s.Privacy != "" && s.Privacy != "all"
+}
+
+// wantAlbum reports whether album passes the --album, --category, and
+// --privacy filters.
+func (s *Syncer) wantAlbum(album *smugmug.AlbumInfo) bool {
+	if len(s.Albums) > 0 && !s.Albums.match(album.Title) {
+		return false
+	}
+	if len(s.Categories) > 0 && !s.Categories.match(album.Category.Name) {
+		return false
+	}
+	switch s.Privacy {
+	case "public":
+		return album.Public
+	case "private":
+		return !album.Public
+	}
+	return true
+}
+
+// wantFile reports whether the file at path (relative to the target
+// directory) passes the --include and --exclude filters. Patterns are
+// matched against both the file name and the full relative path. Files
+// that are filtered out are neither downloaded nor deleted locally.
+func (s *Syncer) wantFile(path string) bool {
+	name := filepath.Base(path)
+	path = filepath.ToSlash(path)
+	if len(s.Include) > 0 && !s.Include.match(name) && !s.Include.match(path) {
+		return false
+	}
+	if s.Exclude.match(name) || s.Exclude.match(path) {
+		return false
+	}
+	return true
+}
+
+// tooBig reports whether image is over MaxFileSize. Like filtered files,
+// images that are too big are neither downloaded nor deleted locally.
+func (s *Syncer) tooBig(image *smugmug.ImageInfo) bool {
+	return s.MaxFileSize > 0 && int64(image.Size) > s.MaxFileSize
+}
+
+// junkPatterns match files the operating system leaves in folders, and
+// hidden files in general. Nothing synced from the server starts with a
+// dot, since sanitize replaces a leading one.
+var junkPatterns = Patterns{".*", "Thumbs.db", "desktop.ini"}
+
+// ignored reports whether a local file or directory at path (relative to
+// the target directory) should be left out of the scan entirely, so that
+// it is never hashed, never matched against the server, and never deleted.
+func (s *Syncer) ignored(path string) bool {
+	name := filepath.Base(path)
+	return junkPatterns.match(name) || s.Ignore.match(name) || s.protected(path) ||
+		s.outputs[filepath.Join(s.Dir, path)]
+}
+
+// protected reports whether path (relative to the target directory) or
+// any directory it is in matches a --protect pattern. Protected paths
+// hold files that are not from SmugMug at all, so images that would be
+// saved there are skipped too rather than overwriting them.
+func (s *Syncer) protected(path string) bool {
+	if len(s.Protect) == 0 {
+		return false
+	}
+	for p := filepath.ToSlash(path); p != "." && p != "/"; p = filepath.ToSlash(filepath.Dir(p)) {
+		if s.Protect.match(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package syncer
+
+import (
+	"sync"
+)
+
+// md5Index maps MD5 sums to the full path of a local file with that
+// content. It is safe for concurrent use.
+type md5Index struct {
+	sync.Mutex
+	paths map[string]string
+}
+
+func newIndex() *md5Index {
+	return &md5Index{paths: make(map[string]string)}
+}
+
+// add records that the file at path has the given sum.
+func (x *md5Index) add(sum, path string) {
+	x.Lock()
+	defer x.Unlock()
+	x.paths[sum] = path
+}
+
+// lookup returns a file with the given sum.
+func (x *md5Index) lookup(sum string) (string, bool) {
+	x.Lock()
+	defer x.Unlock()
+	path, ok := x.paths[sum]
+	return path, ok
+}
+
+// orphanIndex maps MD5 sums to local files that no image on the server
+// claims, so a file that was renamed or moved on the server can be moved
+// into its new place locally. Each file can be taken only once. It is safe
+// for concurrent use.
+type orphanIndex struct {
+	sync.Mutex
+	paths map[string][]string
+}
+
+func newOrphanIndex() *orphanIndex {
+	return &orphanIndex{paths: make(map[string][]string)}
+}
+
+// add records an orphaned file at path with the given sum.
+func (x *orphanIndex) add(sum, path string) {
+	x.Lock()
+	defer x.Unlock()
+	x.paths[sum] = append(x.paths[sum], path)
+}
+
+// take returns an orphaned file with the given sum and removes it from the
+// index.
+func (x *orphanIndex) take(sum string) (string, bool) {
+	x.Lock()
+	defer x.Unlock()
+	paths := x.paths[sum]
+	if len(paths) == 0 {
+		return "", false
+	}
+	path := paths[len(paths)-1]
+	if len(paths) == 1 {
+		delete(x.paths, sum)
+	} else {
+		x.paths[sum] = paths[:len(paths)-1]
+	}
+	return path, true
+}
@@ -0,0 +1,74 @@
+package syncer
+
+import (
+	"fmt"
+)
+
+// albumJob is the part of a run that syncs one album. When several albums
+// are synced at once, each one's log messages are held back and written
+// out together when it is done, so that the output of different albums
+// is not interleaved.
+type albumJob struct {
+	*Syncer
+	album string // title, once processAlbum has started
+	dir   string // and its path in the album layout
+	held  bool
+	lines []string
+}
+
+// newJob returns a job for one album, holding back its log messages if
+// more than one album is being synced at a time.
+func (s *Syncer) newJob() *albumJob {
+	return &albumJob{Syncer: s, held: s.jobs > 1}
+}
+
+// logf adds a message to the album's log, or logs it straight away if
+// messages are not being held back.
+func (s *albumJob) logf(format string, v ...interface{}) {
+	if !s.held {
+		s.Syncer.logf(format, v...)
+		return
+	}
+	s.lines = append(s.lines, fmt.Sprintf(format, v...))
+}
+
+func (s *albumJob) errorf(format string, v ...interface{}) {
+	s.logf("ERROR: "+format, v...)
+}
+
+func (s *albumJob) warnf(format string, v ...interface{}) {
+	s.logf(format, v...)
+}
+
+func (s *albumJob) infof(format string, v ...interface{}) {
+	if s.Verbosity >= Normal {
+		s.logf(format, v...)
+	}
+}
+
+func (s *albumJob) debugf(format string, v ...interface{}) {
+	if s.Verbosity >= Verbose {
+		s.logf(format, v...)
+	}
+}
+
+// flush writes out the messages held back so far in one piece.
+func (s *albumJob) flush() {
+	s.promptMu.Lock()
+	defer s.promptMu.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked is flush for callers that already hold promptMu.
+func (s *albumJob) flushLocked() {
+	for _, line := range s.lines {
+		s.Syncer.logf("%s", line)
+	}
+	s.lines = nil
+}
+
+// countError logs an error in the album's log and adds it to the result.
+func (s *albumJob) countError(err error) {
+	s.errorf("%v", err)
+	s.addError(err)
+}
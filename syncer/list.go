@@ -0,0 +1,80 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// Listing is one album on the server, as returned by List.
+type Listing struct {
+	Account     string
+	Category    string
+	SubCategory string
+	Album       string
+	Key         string
+	Images      int
+	Bytes       int64
+}
+
+// List logs in to every account and returns its albums that pass the
+// album filters, with how many images each holds and their total size.
+// Nothing local is scanned or changed.
+func (s *Syncer) List(ctx context.Context) ([]Listing, error) {
+	if err := s.prepare(time.Now()); err != nil {
+		return nil, err
+	}
+	var list []Listing
+	for _, a := range s.accounts() {
+		if ctx.Err() != nil {
+			return list, ctx.Err()
+		}
+		c, err := s.login(a)
+		if err != nil {
+			return list, err
+		}
+		var albums []*smugmug.AlbumInfo
+		err = s.withRetry(ctx, "listing albums", func() error {
+			var err error
+			albums, err = c.albums(s.NickName)
+			return retryable(err)
+		})
+		if err != nil {
+			return list, fmt.Errorf("Albums error: %v", err)
+		}
+		for _, album := range albums {
+			if ctx.Err() != nil {
+				return list, ctx.Err()
+			}
+			if !s.wantAlbum(album) {
+				continue
+			}
+			var images []*smugmug.ImageInfo
+			err := s.withRetry(ctx, "listing "+s.albumPath(album), func() error {
+				var err error
+				images, err = c.images(album)
+				return retryable(err)
+			})
+			if err != nil {
+				return list, fmt.Errorf("Images error for album %s: %v", album.Title, err)
+			}
+			l := Listing{
+				Account:  a.Name,
+				Category: album.Category.Name,
+				Album:    album.Title,
+				Key:      album.Key,
+				Images:   len(images),
+			}
+			if album.SubCategory != nil {
+				l.SubCategory = album.SubCategory.Name
+			}
+			for _, image := range images {
+				l.Bytes += int64(image.Size)
+			}
+			list = append(list, l)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,51 @@
+package syncer
+
+import (
+	"log"
+)
+
+// Level is how much a Syncer logs.
+type Level int
+
+// Logging levels, from least to most output.
+const (
+	Quiet Level = iota
+	Normal
+	Verbose
+)
+
+// logf logs to the Syncer's logger, or the standard one if it has none.
+func (s *Syncer) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// errorf logs an error, marked as one so that failures are easy to find
+// in a log. Errors are shown at every level.
+func (s *Syncer) errorf(format string, v ...interface{}) {
+	s.logf("ERROR: "+format, v...)
+}
+
+// warnf logs a problem. Warnings are shown at every level.
+func (s *Syncer) warnf(format string, v ...interface{}) {
+	s.logf(format, v...)
+}
+
+// infof logs something that changes (or in a dry run, would change) local
+// files, such as a download or a deletion. These are hidden at Quiet.
+func (s *Syncer) infof(format string, v ...interface{}) {
+	if s.Verbosity >= Normal {
+		s.logf(format, v...)
+	}
+}
+
+// debugf logs routine progress such as files skipped because they are
+// unchanged. These are only shown at Verbose.
+func (s *Syncer) debugf(format string, v ...interface{}) {
+	if s.Verbosity >= Verbose {
+		s.logf(format, v...)
+	}
+}
@@ -0,0 +1,123 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/russross/smugmug"
+)
+
+// manifestEntry describes one image on the server and what the sync did
+// with it.
+type manifestEntry struct {
+	Account     string `json:"account,omitempty"`
+	Category    string `json:"category"`
+	SubCategory string `json:"subcategory,omitempty"`
+	Album       string `json:"album"`
+	FileName    string `json:"filename"`
+	Path        string `json:"path,omitempty"`
+	MD5         string `json:"md5"`
+	Checksum    string `json:"checksum,omitempty"` // algorithm:sum of the local copy
+	Size        int    `json:"size"`
+	URL         string `json:"url,omitempty"`
+	Status      string `json:"status"`
+}
+
+// manifest collects an entry for every image seen during a run. It is safe
+// for concurrent use.
+type manifest struct {
+	sync.Mutex
+	entries []manifestEntry
+}
+
+// manifestEntry returns the start of image's manifest entry, for the
+// caller to fill in the path and status.
+func (s *Syncer) manifestEntry(album *smugmug.AlbumInfo, image *smugmug.ImageInfo) manifestEntry {
+	e := manifestEntry{
+		Account:  s.accountName,
+		Category: album.Category.Name,
+		Album:    album.Title,
+		FileName: image.FileName,
+		MD5:      image.MD5Sum,
+		Size:     image.Size,
+	}
+	if album.SubCategory != nil {
+		e.SubCategory = album.SubCategory.Name
+	}
+	return e
+}
+
+// recordUnsynced adds the images of an album the run skipped over to the
+// manifest, which lists every image on the server and not just the ones
+// that were looked at. They are listed to do so, and if that fails the
+// album is left out with a warning rather than failing the run.
+func (s *albumJob) recordUnsynced(ctx context.Context, c *session, album *smugmug.AlbumInfo) {
+	if s.ManifestFile == "" {
+		return
+	}
+	path := s.albumPath(album)
+	images, ok := s.listings[album]
+	if !ok {
+		err := s.withRetry(ctx, "listing "+path, func() error {
+			var err error
+			images, err = c.images(album)
+			return retryable(err)
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				s.warnf("WARNING: unable to list %s, so it is missing from the manifest: %v", path, err)
+			}
+			return
+		}
+	}
+	s.findDuplicates(images)
+	s.assignNumbers(images)
+	for _, image := range images {
+		e := s.manifestEntry(album, image)
+		e.Path, _ = s.imagePath(album, image)
+		e.Status = "not synced"
+		s.inventory.add(e)
+	}
+}
+
+func (m *manifest) add(e manifestEntry) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries = append(m.entries, e)
+}
+
+// save writes the entries to path as a JSON array, sorted by album and
+// file name so that manifests from different runs can be compared.
+func (m *manifest) save(path string) error {
+	m.Lock()
+	defer m.Unlock()
+	sort.Slice(m.entries, func(i, j int) bool {
+		a, b := m.entries[i], m.entries[j]
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.SubCategory != b.SubCategory {
+			return a.SubCategory < b.SubCategory
+		}
+		if a.Album != b.Album {
+			return a.Album < b.Album
+		}
+		return a.FileName < b.FileName
+	})
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+	data = append(data, '\n')
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing manifest %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/russross/smugmug"
+)
+
+// renumberSuffix is appended to files while they are being renumbered.
+const renumberSuffix = ".renumber"
+
+// numberIndex holds the --number prefix of every image listed so far. It
+// is safe for concurrent use.
+type numberIndex struct {
+	sync.Mutex
+	prefixes map[*smugmug.ImageInfo]string
+}
+
+// assignNumbers records the position of each image in an album's listing,
+// zero padded to the same width throughout the album, for --number.
+func (s *Syncer) assignNumbers(images []*smugmug.ImageInfo) {
+	if !s.Number {
+		return
+	}
+	width := len(fmt.Sprint(len(images)))
+	if width < 3 {
+		width = 3
+	}
+	s.numbers.Lock()
+	defer s.numbers.Unlock()
+	for i, image := range images {
+		s.numbers.prefixes[image] = fmt.Sprintf("%0*d_", width, i+1)
+	}
+}
+
+// numberPrefix returns the --number prefix for image.
+func (s *Syncer) numberPrefix(image *smugmug.ImageInfo) string {
+	s.numbers.Lock()
+	defer s.numbers.Unlock()
+	return s.numbers.prefixes[image]
+}
+
+// unnumbered returns path, which is relative to the target directory, with
+// any --number prefix taken off the file name.
+func (s *Syncer) unnumbered(album *smugmug.AlbumInfo, path string) string {
+	dir, name := filepath.Split(path)
+	pre := ""
+	if s.Layout == "flat" {
+		pre = s.flatPrefixes[album]
+		if !strings.HasPrefix(name, pre) {
+			return path
+		}
+		name = name[len(pre):]
+	}
+	i := 0
+	for i < len(name) && name[i] >= '0' && name[i] <= '9' {
+		i++
+	}
+	if i > 0 && i < len(name) && name[i] == '_' {
+		name = name[i+1:]
+	}
+	return dir + pre + name
+}
+
+// renumber renames the local copies of images that have moved to a new
+// position in the album since the last sync, so they are not downloaded
+// again and their old names are not cleaned up. A local file is taken to
+// be a renumbered copy of an image if it has the same name apart from the
+// number and, for originals, the same MD5 sum. Files are first moved out
+// of the way and then into place, so images that swapped positions do not
+// overwrite each other.
+func (s *albumJob) renumber(album *smugmug.AlbumInfo, images []*smugmug.ImageInfo, localFiles *fileSet) error {
+	// verifying changes nothing, so renumbered files show up as missing
+	if !s.Number || s.Verify {
+		return nil
+	}
+
+	// local files by their name without a number
+	local := localFiles.entries()
+	byName := make(map[string][]string)
+	for k, v := range local {
+		if v != "directory" {
+			u := s.unnumbered(album, k)
+			byName[u] = append(byName[u], k)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, image := range images {
+		if p, err := s.imagePath(album, image); err == nil {
+			wanted[p] = true
+		}
+	}
+
+	type rename struct{ from, to, sum, checksum string }
+	var renames []rename
+	taken := make(map[string]bool)
+	for _, image := range images {
+		path, err := s.imagePath(album, image)
+		if err != nil || local[path] == image.MD5Sum {
+			continue
+		}
+		byContent := !isVideo(image.Format) && s.Size == "original"
+		if !byContent && local[path] != "" {
+			continue
+		}
+		for _, k := range byName[s.unnumbered(album, path)] {
+			if k == path || wanted[k] || taken[k] || byContent && local[k] != image.MD5Sum {
+				continue
+			}
+			taken[k] = true
+			renames = append(renames, rename{from: k, to: path, sum: local[k]})
+			break
+		}
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+
+	if s.Dry {
+		for _, r := range renames {
+			s.infof("    %s: dry run, not renumbering from %s", r.to, r.from)
+			localFiles.remove(r.from)
+			localFiles.set(r.to, r.sum)
+		}
+		s.countRenumbered(len(renames))
+		return nil
+	}
+	for i, r := range renames {
+		from := filepath.Join(s.Dir, r.from)
+		renames[i].checksum = s.knownChecksum(r.from)
+		if err := os.Rename(from, from+renumberSuffix); err != nil {
+			return fmt.Errorf("failed to rename %s: %v", from, err)
+		}
+		localFiles.remove(r.from)
+		s.cache.remove(r.from)
+	}
+	for _, r := range renames {
+		from, to := filepath.Join(s.Dir, r.from)+renumberSuffix, filepath.Join(s.Dir, r.to)
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %v", from, to, err)
+		}
+		s.infof("    %s: renumbered from %s", r.to, r.from)
+		localFiles.set(r.to, r.sum)
+		s.storeCreated(r.to, r.sum, r.checksum)
+	}
+	s.countRenumbered(len(renames))
+	return nil
+}
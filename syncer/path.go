@@ -0,0 +1,376 @@
+package syncer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/russross/smugmug"
+)
+
+// albumPath returns the directory for an album relative to the target
+// directory. Every component is sanitized, so the same album always maps
+// to the same place no matter what characters its names contain.
+func (s *Syncer) albumPath(album *smugmug.AlbumInfo) string {
+	path := s.sanitize(album.Category.Name)
+	if album.SubCategory != nil {
+		path = filepath.Join(path, s.sanitize(album.SubCategory.Name))
+	}
+	return filepath.Join(path, s.sanitize(album.Title))
+}
+
+// imagePath returns the local path of an image relative to the target
+// directory.
+func (s *Syncer) imagePath(album *smugmug.AlbumInfo, image *smugmug.ImageInfo) (string, error) {
+	name := imageName(image)
+	if name == "" {
+		return "", fmt.Errorf("image with no filename: ID=%d Key=%s Album=%v", image.ID, image.Key, image.Album)
+	}
+	name = s.sanitize(name)
+	if s.isDuplicate(image) {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_" + s.sanitize(image.Key) + ext
+	}
+	name = shorten(s.numberPrefix(image) + name)
+	if s.pathTemplate != nil {
+		return s.templatePath(album, image, name)
+	}
+	if s.Layout == "flat" {
+		return shorten(s.flatPrefixes[album] + name), nil
+	}
+	return filepath.Join(s.albumPath(album), name), nil
+}
+
+// imageName returns the image's file name on the server. Some old uploads
+// have none, so those are named after the image key (or ID) and format
+// instead, e.g. image_abc123.jpg. It returns "" if there is nothing to go
+// on.
+func imageName(image *smugmug.ImageInfo) string {
+	if image.FileName != "" {
+		return image.FileName
+	}
+	id := image.Key
+	if id == "" && image.ID != 0 {
+		id = strconv.Itoa(image.ID)
+	}
+	if id == "" {
+		return ""
+	}
+	ext := ".jpg"
+	if image.Format != "" {
+		ext = "." + strings.ToLower(image.Format)
+	}
+	return "image_" + id + ext
+}
+
+// AlbumTemplate is the path template that gives the same paths as the
+// album layout.
+const AlbumTemplate = "{{.Category}}/{{.SubCategory}}/{{.Album}}/{{.FileName}}"
+
+// DateTemplate is the path template for the date layout, which files
+// images by the year and month of their date on the server, as for the
+// template's date fields. Images with no date go in "undated".
+const DateTemplate = "{{if .Year}}{{.Year}}/{{.Month}}{{else}}undated{{end}}/{{.FileName}}"
+
+// templateData is what a path template is given for each image. Every
+// field is sanitized, so only the slashes in the template itself separate
+// directories. The date fields come from the image's date on the server
+// and are empty if it has none.
+type templateData struct {
+	Category    string
+	SubCategory string
+	Album       string
+	AlbumKey    string
+	FileName    string // including any number and duplicate key
+	Key         string
+	Year        string
+	Month       string
+	Day         string
+}
+
+// parseTemplate compiles a path template. It is tried out on empty data
+// so that unknown fields are caught before anything is synced.
+func parseTemplate(text string) (*template.Template, error) {
+	t, err := template.New("path").Parse(text)
+	if err == nil {
+		err = t.Execute(io.Discard, templateData{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template: %v", err)
+	}
+	return t, nil
+}
+
+// templatePath returns the path the template gives for an image whose
+// file name is name. Empty directories in the result are dropped, so a
+// missing subcategory leaves no gap.
+func (s *Syncer) templatePath(album *smugmug.AlbumInfo, image *smugmug.ImageInfo, name string) (string, error) {
+	data := templateData{
+		Category: s.sanitize(album.Category.Name),
+		Album:    s.sanitize(album.Title),
+		AlbumKey: s.sanitize(album.Key),
+		FileName: name,
+		Key:      s.sanitize(image.Key),
+	}
+	if album.SubCategory != nil {
+		data.SubCategory = s.sanitize(album.SubCategory.Name)
+	}
+	for _, d := range []string{image.Date, image.LastUpdated} {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", d, time.Local); err == nil {
+			data.Year, data.Month, data.Day = t.Format("2006"), t.Format("01"), t.Format("02")
+			break
+		}
+	}
+	var b strings.Builder
+	if err := s.pathTemplate.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error applying template to %s: %v", image.FileName, err)
+	}
+	path := filepath.Clean(filepath.FromSlash(b.String()))
+	if path == "." || filepath.IsAbs(path) {
+		return "", fmt.Errorf("template gives %q for %s, which is not a file in the target directory", b.String(), image.FileName)
+	}
+	parts := strings.Split(path, string(filepath.Separator))
+	for i, part := range parts {
+		// ".." would escape the target directory, and hidden names are
+		// ignored by the scan
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("template gives %q for %s, which has a hidden or parent directory in it", b.String(), image.FileName)
+		}
+		parts[i] = shorten(part)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// shared reports whether every album's files go into one set that is
+// scanned up front and cleaned up at the end, as in the flat layout and
+// with a path template, rather than into a directory per album.
+func (s *Syncer) shared() bool {
+	return s.Layout == "flat" || s.pathTemplate != nil
+}
+
+// duplicateIndex holds the images whose file names clash with another
+// image in the same album. It is safe for concurrent use.
+type duplicateIndex struct {
+	sync.Mutex
+	images map[*smugmug.ImageInfo]bool
+}
+
+// findDuplicates records the images in an album's listing that share a
+// file name with another one. SmugMug allows this, but the local copies
+// would overwrite each other, so every one of them gets its image key
+// added to the name, e.g. IMG_4432_abc123.jpg. When case is being ignored,
+// names that differ only in case count as the same.
+func (s *Syncer) findDuplicates(images []*smugmug.ImageInfo) {
+	byName := make(map[string][]*smugmug.ImageInfo)
+	for _, image := range images {
+		if name := imageName(image); name != "" {
+			name = s.sanitize(name)
+			if s.foldCase {
+				name = strings.ToLower(name)
+			}
+			byName[name] = append(byName[name], image)
+		}
+	}
+	s.duplicates.Lock()
+	defer s.duplicates.Unlock()
+	for _, group := range byName {
+		if len(group) > 1 {
+			for _, image := range group {
+				s.duplicates.images[image] = true
+			}
+		}
+	}
+}
+
+// isDuplicate reports whether image shares its file name with another
+// image in its album.
+func (s *Syncer) isDuplicate(image *smugmug.ImageInfo) bool {
+	s.duplicates.Lock()
+	defer s.duplicates.Unlock()
+	return s.duplicates.images[image]
+}
+
+// findDateCollisions lists the images of every album on the server and
+// treats images from different albums that would end up at the same path
+// in the date layout as duplicates, so each gets its image key added to
+// its name. Albums that are filtered out or skipped this time are listed
+// too, since otherwise an image's name would depend on which albums were
+// synced and could change from one run to the next. The listings are kept
+// so they are not fetched again.
+func (s *Syncer) findDateCollisions(ctx context.Context, c *session, albums []*smugmug.AlbumInfo) {
+	byPath := make(map[string][]*smugmug.ImageInfo)
+	for _, album := range albums {
+		if ctx.Err() != nil {
+			return
+		}
+		images, ok := s.listings[album]
+		if !ok {
+			err := s.withRetry(ctx, "listing "+s.albumPath(album), func() error {
+				var err error
+				images, err = c.images(album)
+				return retryable(err)
+			})
+			if err != nil {
+				// processAlbum will try again and report it
+				continue
+			}
+			s.checkTruncated(len(images), "images", s.albumPath(album))
+			s.listings[album] = images
+		}
+		s.findDuplicates(images)
+		s.assignNumbers(images)
+		for _, image := range images {
+			path, err := s.imagePath(album, image)
+			if err != nil {
+				continue
+			}
+			if s.foldCase {
+				path = strings.ToLower(path)
+			}
+			byPath[path] = append(byPath[path], image)
+		}
+	}
+	s.duplicates.Lock()
+	defer s.duplicates.Unlock()
+	for _, group := range byPath {
+		if len(group) > 1 {
+			for _, image := range group {
+				s.duplicates.images[image] = true
+			}
+		}
+	}
+}
+
+// assignFlatPrefixes works out the file name prefix for every album in the
+// flat layout, which is the category, subcategory, and title joined by
+// underscores. Albums that would end up with the same prefix also get
+// their album key so their files cannot collide. All albums on the server
+// should be passed in, not just the ones being synced, so the prefixes do
+// not change with the filters.
+func (s *Syncer) assignFlatPrefixes(albums []*smugmug.AlbumInfo) {
+	groups := make(map[string][]*smugmug.AlbumInfo)
+	for _, album := range albums {
+		parts := []string{s.sanitize(album.Category.Name)}
+		if album.SubCategory != nil {
+			parts = append(parts, s.sanitize(album.SubCategory.Name))
+		}
+		parts = append(parts, s.sanitize(album.Title))
+		prefix := strings.Join(parts, "_")
+		groups[prefix] = append(groups[prefix], album)
+	}
+	for prefix, group := range groups {
+		for _, album := range group {
+			if len(group) > 1 {
+				s.flatPrefixes[album] = prefix + "_" + s.sanitize(album.Key) + "_"
+			} else {
+				s.flatPrefixes[album] = prefix + "_"
+			}
+		}
+	}
+}
+
+// flatAlbum returns the album whose prefix name starts with, the one with
+// the longest prefix if there are several, or nil if there is none.
+func (s *Syncer) flatAlbum(name string) *smugmug.AlbumInfo {
+	var found *smugmug.AlbumInfo
+	for album, prefix := range s.flatPrefixes {
+		if strings.HasPrefix(name, prefix) && (found == nil || len(prefix) > len(s.flatPrefixes[found])) {
+			found = album
+		}
+	}
+	return found
+}
+
+// hasFlatPrefix reports whether name starts with the prefix of any album.
+func (s *Syncer) hasFlatPrefix(name string) bool {
+	for _, prefix := range s.flatPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitize makes name safe to use as a single path component. Path
+// separators and NUL bytes are replaced, as is a leading dot so that the
+// result is never hidden or one of "." and "..". With Portable, so are the
+// characters and names Windows does not allow, and trailing dots and
+// spaces are trimmed. Names too long for the file system are shortened.
+func (s *Syncer) sanitize(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/', r == '\\', r == 0:
+			return '_'
+		case s.Portable && (r < ' ' || strings.ContainsRune(`<>:"|?*`, r)):
+			return '_'
+		}
+		return r
+	}, name)
+	if s.Portable {
+		name = strings.TrimRight(name, ". ")
+		base := name
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			name = "_" + name
+		}
+	}
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+	if name == "" {
+		name = "_"
+	}
+	return shorten(name)
+}
+
+// reservedNames are the device names Windows will not use as file names,
+// even with an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// maxNameLength is the longest path component, in bytes, that common file
+// systems allow.
+const maxNameLength = 255
+
+// nameLimit is how long a name may be before it is shortened. It leaves
+// room for the longest name derived from it: a sidecar being downloaded
+// into TempDir, which adds a hash prefix and both suffixes.
+const nameLimit = maxNameLength - len("0123456789abcdef_") - len(sidecarSuffix) - len(partialSuffix)
+
+// shorten cuts a path component that is too long down to size, keeping
+// its extension. A hash of the full name is added so that long names
+// that start the same way stay different.
+func shorten(name string) string {
+	if len(name) <= nameLimit {
+		return name
+	}
+	sum := md5.Sum([]byte(name))
+	tag := "~" + hex.EncodeToString(sum[:4])
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	keep := nameLimit - len(tag) - len(ext)
+	base := name[:keep]
+	// do not leave half a UTF-8 sequence behind
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + tag + ext
+}
@@ -0,0 +1,206 @@
+package syncer
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/russross/smugmug"
+)
+
+func TestSanitize(t *testing.T) {
+	s := New()
+	s.Portable = false
+	tests := []struct {
+		in, want string
+	}{
+		{"Trip: NYC / 2023", "Trip: NYC _ 2023"},
+		{`Back\slash`, "Back_slash"},
+		{"nul\x00byte", "nul_byte"},
+		{".hidden", "_hidden"},
+		{"..", "_."},
+		{".", "_"},
+		{"", "_"},
+		{"Plain name.jpg", "Plain name.jpg"},
+	}
+	for _, tt := range tests {
+		if got := s.sanitize(tt.in); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	s.Portable = true
+	if got, want := s.sanitize("Trip: NYC / 2023"), "Trip_ NYC _ 2023"; got != want {
+		t.Errorf("portable sanitize = %q, want %q", got, want)
+	}
+}
+
+func TestAlbumPath(t *testing.T) {
+	s := New()
+	s.Portable = false
+	album := &smugmug.AlbumInfo{
+		Title:       "Trip: NYC / 2023",
+		Category:    &smugmug.CategoryInfo{Name: "Travel/US"},
+		SubCategory: &smugmug.SubCategoryInfo{Name: "../East"},
+	}
+	got := s.albumPath(album)
+	want := filepath.Join("Travel_US", "_._East", "Trip: NYC _ 2023")
+	if got != want {
+		t.Errorf("albumPath = %q, want %q", got, want)
+	}
+	if strings.Count(got, string(filepath.Separator)) != 2 {
+		t.Errorf("albumPath %q is not three components deep", got)
+	}
+}
+
+func TestSanitizePortable(t *testing.T) {
+	s := New()
+	s.Portable = true
+	tests := []struct {
+		in, want string
+	}{
+		{"CON", "_CON"},
+		{"con.jpg", "_con.jpg"},
+		{"LPT1 .txt", "_LPT1 .txt"},
+		{"CONSOLE.jpg", "CONSOLE.jpg"},
+		{"Notes.", "Notes"},
+		{"Notes. . ", "Notes"},
+		{"...", "_"},
+	}
+	for _, tt := range tests {
+		if got := s.sanitize(tt.in); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeLongName(t *testing.T) {
+	s := New()
+	long := strings.Repeat("a", 300) + ".jpg"
+	got := s.sanitize(long)
+	if len(got) > nameLimit {
+		t.Fatalf("sanitize left %d bytes, want at most %d", len(got), nameLimit)
+	}
+	if filepath.Ext(got) != ".jpg" {
+		t.Errorf("sanitize(%q...) = %q, lost the extension", long[:10], got)
+	}
+	if other := s.sanitize(strings.Repeat("a", 300) + "b.jpg"); other == got {
+		t.Errorf("names that differ after the cut both became %q", got)
+	}
+
+	// the longest name derived from it must still fit
+	s.TempDir = t.TempDir()
+	part := filepath.Base(s.partialPath(filepath.Join("album", got) + sidecarSuffix))
+	if len(part) > maxNameLength {
+		t.Errorf("partial sidecar name is %d bytes, want at most %d", len(part), maxNameLength)
+	}
+
+	// multibyte runes are not cut in half
+	got = s.sanitize(strings.Repeat("é", 200))
+	if len(got) > nameLimit || !utf8.ValidString(got) {
+		t.Errorf("sanitize left an invalid or overlong name: %q", got)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	s := newTestSyncer(t)
+	album := testAlbum("Trip")
+	first := &smugmug.ImageInfo{Key: "abc123", FileName: "IMG_4432.jpg", Format: "JPG", MD5Sum: "11111111111111111111111111111111"}
+	second := &smugmug.ImageInfo{Key: "def456", FileName: "IMG_4432.jpg", Format: "JPG", MD5Sum: "22222222222222222222222222222222"}
+	other := &smugmug.ImageInfo{Key: "ghi789", FileName: "IMG_4433.jpg", Format: "JPG", MD5Sum: "33333333333333333333333333333333"}
+	s.findDuplicates([]*smugmug.ImageInfo{first, second, other})
+
+	dir := s.albumPath(album)
+	tests := []struct {
+		image *smugmug.ImageInfo
+		want  string
+	}{
+		{first, filepath.Join(dir, "IMG_4432_abc123.jpg")},
+		{second, filepath.Join(dir, "IMG_4432_def456.jpg")},
+		{other, filepath.Join(dir, "IMG_4433.jpg")},
+	}
+	for _, tt := range tests {
+		got, err := s.imagePath(album, tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("imagePath(%s) = %q, want %q", tt.image.Key, got, tt.want)
+		}
+	}
+}
+
+func TestImageNameWithoutFileName(t *testing.T) {
+	tests := []struct {
+		image *smugmug.ImageInfo
+		want  string
+	}{
+		{&smugmug.ImageInfo{FileName: "IMG_1.jpg", Key: "abc123", Format: "JPG"}, "IMG_1.jpg"},
+		{&smugmug.ImageInfo{Key: "abc123", Format: "PNG"}, "image_abc123.png"},
+		{&smugmug.ImageInfo{ID: 42, Format: "MP4"}, "image_42.mp4"},
+		{&smugmug.ImageInfo{Key: "abc123"}, "image_abc123.jpg"},
+		{&smugmug.ImageInfo{}, ""},
+	}
+	for _, tt := range tests {
+		if got := imageName(tt.image); got != tt.want {
+			t.Errorf("imageName(%+v) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+
+	s := newTestSyncer(t)
+	album := testAlbum("Trip")
+	got, err := s.imagePath(album, &smugmug.ImageInfo{Key: "abc123", Format: "JPG"})
+	if want := filepath.Join(s.albumPath(album), "image_abc123.jpg"); err != nil || got != want {
+		t.Errorf("imagePath = %q, %v; want %q", got, err, want)
+	}
+	if _, err := s.imagePath(album, &smugmug.ImageInfo{}); err == nil {
+		t.Errorf("imagePath of an image with no name, key, or ID did not fail")
+	}
+}
+
+func TestFlatAlbum(t *testing.T) {
+	s := newTestSyncer(t)
+	s.Layout = "flat"
+	trip, other := testAlbum("Trip"), testAlbum("Trip")
+	other.Category = &smugmug.CategoryInfo{Name: "Work"}
+	s.flatPrefixes[trip] = "Other_Trip_"
+	s.flatPrefixes[other] = "Other_Trip_x_"
+	if got := s.flatAlbum("Other_Trip_x_a.jpg"); got != other {
+		t.Errorf("flatAlbum picked %v, want the album with the longer prefix", got)
+	}
+	if got := s.flatAlbum("Other_Trip_a.jpg"); got != trip {
+		t.Errorf("flatAlbum picked %v, want %v", got, trip)
+	}
+	if got := s.flatAlbum("a.jpg"); got != nil {
+		t.Errorf("flatAlbum of a file with no prefix = %v, want nil", got)
+	}
+}
+
+func TestDateCollisionsIncludeSkippedAlbums(t *testing.T) {
+	s := newTestSyncer(t)
+	s.Layout = "date"
+	if err := s.prepare(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	old, recent := testAlbum("Old"), testAlbum("Recent")
+	recent.LastUpdated = time.Now().Format("2006-01-02 15:04:05")
+	first := &smugmug.ImageInfo{Key: "abc123", FileName: "IMG_1.jpg", Format: "JPG"}
+	second := &smugmug.ImageInfo{Key: "def456", FileName: "IMG_1.jpg", Format: "JPG"}
+	s.listings[old] = []*smugmug.ImageInfo{first}
+	s.listings[recent] = []*smugmug.ImageInfo{second}
+
+	// the old album is not synced with --since, but its image still
+	// decides what the recent one is called
+	s.Since = time.Now().Add(-time.Minute)
+	s.findDateCollisions(context.Background(), nil, []*smugmug.AlbumInfo{old, recent})
+	got, err := s.imagePath(recent, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("undated", "IMG_1_def456.jpg"); got != want {
+		t.Errorf("imagePath = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package syncer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/russross/smugmug"
+)
+
+// session is a logged-in connection to one account. SmugMug sessions
+// expire, which a sync of a big account can outlast, so when the server
+// says the session is no longer valid we log in again with the same
+// credentials and repeat the call. It is safe for concurrent use.
+type session struct {
+	s       *Syncer
+	account Account
+
+	mu   sync.Mutex
+	conn client
+	nick string
+}
+
+// client is the part of a smugmug connection that a session uses.
+type client interface {
+	Albums(nick string) ([]*smugmug.AlbumInfo, error)
+	Images(album *smugmug.AlbumInfo) ([]*smugmug.ImageInfo, error)
+}
+
+// dial logs in and returns the connection and the account's nickname.
+// Tests replace it to stand in for the server.
+var dial = func(a Account) (client, string, error) {
+	c, err := smugmug.Login(a.Email, a.Password, a.APIKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, c.NickName, nil
+}
+
+// login logs in to account and returns a session for it.
+func (s *Syncer) login(a Account) (*session, error) {
+	c, nick, err := dial(a)
+	if err != nil {
+		return nil, fmt.Errorf("Login error for %s: %v", a.Email, err)
+	}
+	return &session{s: s, account: a, conn: c, nick: nick}, nil
+}
+
+// nickName returns the account's nickname.
+func (c *session) nickName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// albums lists the albums of the user with the given nickname, or the
+// account's own albums if it is "". Only public albums can be seen for
+// other users.
+func (c *session) albums(nick string) ([]*smugmug.AlbumInfo, error) {
+	var albums []*smugmug.AlbumInfo
+	if nick == "" {
+		nick = c.nickName()
+	}
+	err := c.call(func(conn client) error {
+		var err error
+		albums, err = conn.Albums(nick)
+		return err
+	})
+	return albums, err
+}
+
+// images lists the images in album.
+func (c *session) images(album *smugmug.AlbumInfo) ([]*smugmug.ImageInfo, error) {
+	var images []*smugmug.ImageInfo
+	err := c.call(func(conn client) error {
+		var err error
+		images, err = conn.Images(album)
+		return err
+	})
+	return images, err
+}
+
+// call runs fn with the connection, and if it fails because the session
+// has expired, logs in again and runs it once more. When several jobs find
+// the session expired at once, only the first of them logs in again.
+func (c *session) call(fn func(client) error) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	err := fn(conn)
+	if err == nil || !sessionExpired(err) {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.conn == conn {
+		c.s.infof("Session for %s has expired, logging in again", c.account.Email)
+		fresh, nick, err := dial(c.account)
+		if err != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("Login error for %s: %v", c.account.Email, err)
+		}
+		c.conn, c.nick = fresh, nick
+	}
+	conn = c.conn
+	c.mu.Unlock()
+	return fn(conn)
+}
+
+// retryable marks an error from a listing call as worth trying again,
+// unless it is one the server would only give again, such as bad
+// credentials or a missing album. A listing that still fails is reported
+// as an error; it is never taken to mean the album is empty.
+func retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"invalid login", "invalid user", "invalid api key", "password", "permission", "access denied", "not found"} {
+		if strings.Contains(msg, s) {
+			return err
+		}
+	}
+	return retryableError{err: err}
+}
+
+// sessionExpired reports whether err is the server saying the session is
+// no longer valid, as opposed to any other failure.
+func sessionExpired(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "invalid session") || strings.Contains(msg, "session expired") ||
+		strings.Contains(msg, "expired session")
+}
@@ -0,0 +1,225 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// fakeServer stands in for SmugMug. Sessions are only valid until the
+// next login or until expire is called, and listings fail with the
+// errors in fail, one per call, before they succeed. Image listings
+// take delay, and the most there were at once is kept in busiest.
+type fakeServer struct {
+	mu      sync.Mutex
+	albums  []*smugmug.AlbumInfo
+	images  map[string][]*smugmug.ImageInfo // by album key
+	fail    []error
+	valid   *fakeConn
+	logins  int
+	calls   int
+	delay   time.Duration
+	busy    int
+	busiest int
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+// useFakeServer makes logins connect to server until the test ends.
+func useFakeServer(t *testing.T, server *fakeServer) {
+	t.Helper()
+	old := dial
+	t.Cleanup(func() { dial = old })
+	dial = func(a Account) (client, string, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		server.logins++
+		server.valid = &fakeConn{server: server}
+		return server.valid, "fake", nil
+	}
+}
+
+// expire ends the current session.
+func (f *fakeServer) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.valid = nil
+}
+
+// check counts a call and returns the error it should fail with, if any.
+func (c *fakeConn) check() error {
+	f := c.server
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if c != f.valid {
+		return errors.New("invalid session")
+	}
+	if len(f.fail) > 0 {
+		err := f.fail[0]
+		f.fail = f.fail[1:]
+		return err
+	}
+	return nil
+}
+
+func (c *fakeConn) Albums(nick string) ([]*smugmug.AlbumInfo, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.server.albums, nil
+}
+
+func (c *fakeConn) Images(album *smugmug.AlbumInfo) ([]*smugmug.ImageInfo, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	f := c.server
+	f.mu.Lock()
+	f.busy++
+	if f.busy > f.busiest {
+		f.busiest = f.busy
+	}
+	f.mu.Unlock()
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	f.busy--
+	f.mu.Unlock()
+	return f.images[album.Key], nil
+}
+
+func TestSessionExpired(t *testing.T) {
+	server := &fakeServer{albums: []*smugmug.AlbumInfo{testAlbum("Trip")}}
+	useFakeServer(t, server)
+	s := newTestSyncer(t)
+	c, err := s.login(Account{Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if albums, err := c.albums(""); err != nil || len(albums) != 1 {
+		t.Fatalf("first listing = %d albums, %v; want 1", len(albums), err)
+	}
+
+	// the second call finds the session expired, logs in again, and
+	// carries on with the new one
+	server.expire()
+	if albums, err := c.albums(""); err != nil || len(albums) != 1 {
+		t.Fatalf("listing after expiry = %d albums, %v; want 1", len(albums), err)
+	}
+	if server.logins != 2 {
+		t.Errorf("logged in %d times, want 2", server.logins)
+	}
+	if albums, err := c.albums(""); err != nil || len(albums) != 1 {
+		t.Fatalf("listing after logging in again = %d albums, %v; want 1", len(albums), err)
+	}
+	if server.logins != 2 || server.calls != 4 {
+		t.Errorf("logged in %d times for %d calls, want 2 for 4", server.logins, server.calls)
+	}
+
+	// other errors are passed back without logging in again
+	server.fail = []error{errors.New("album not found")}
+	if _, err := c.albums(""); err == nil || sessionExpired(err) {
+		t.Errorf("listing = %v, want the server's error", err)
+	}
+	if server.logins != 2 {
+		t.Errorf("logged in again after an unrelated error")
+	}
+}
+
+func TestListingRetried(t *testing.T) {
+	old := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = old }()
+
+	album := testAlbum("Trip")
+	image := &smugmug.ImageInfo{Key: "abc123", FileName: "a.jpg", Format: "JPG", Size: 10,
+		MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{album},
+		images: map[string][]*smugmug.ImageInfo{album.Key: {image}},
+	}
+	useFakeServer(t, server)
+	s := newTestSyncer(t)
+	s.Dry = true
+	c, err := s.login(Account{Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while planning
+	server.fail = []error{errors.New("connection reset"), errors.New("503 service unavailable")}
+	if files, _ := s.plan(context.Background(), c, []*smugmug.AlbumInfo{album}); files != 1 {
+		t.Errorf("planned %d downloads, want 1", files)
+	}
+	if server.calls != 3 {
+		t.Errorf("listed %d times while planning, want 3", server.calls)
+	}
+
+	// and while syncing
+	delete(s.listings, album)
+	server.calls = 0
+	server.fail = []error{errors.New("connection reset"), errors.New("503 service unavailable")}
+	if err := s.newJob().processAlbum(context.Background(), c, album, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if server.calls != 3 {
+		t.Errorf("listed %d times while syncing, want 3", server.calls)
+	}
+	if st := s.Stats(); st.Downloaded != 1 {
+		t.Errorf("counted %d downloads, want 1", st.Downloaded)
+	}
+
+	// a listing that keeps failing is an error, not an empty album
+	server.calls = 0
+	server.fail = []error{errors.New("a"), errors.New("b"), errors.New("c"), errors.New("d")}
+	if err := s.newJob().processAlbum(context.Background(), c, testAlbum("Other"), 1, 1); err == nil {
+		t.Errorf("processAlbum succeeded after every listing failed")
+	}
+	if server.calls != s.Retries+1 {
+		t.Errorf("listed %d times, want %d", server.calls, s.Retries+1)
+	}
+}
+
+func TestPlanListsInParallel(t *testing.T) {
+	server := &fakeServer{images: make(map[string][]*smugmug.ImageInfo), delay: 20 * time.Millisecond}
+	var albums []*smugmug.AlbumInfo
+	for _, title := range []string{"A", "B", "C", "D", "E"} {
+		album := testAlbum(title)
+		albums = append(albums, album)
+		server.images[album.Key] = []*smugmug.ImageInfo{{Key: title + "1", FileName: "a.jpg", Format: "JPG",
+			Size: 10, MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}}
+	}
+	useFakeServer(t, server)
+	s := New()
+	s.Dir = t.TempDir()
+	s.Jobs = 2
+	if err := s.prepare(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.listings = make(map[*smugmug.AlbumInfo][]*smugmug.ImageInfo)
+	c, err := s.login(Account{Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an album listed before planning is not listed again
+	s.listings[albums[0]] = server.images[albums[0].Key]
+	if files, need := s.plan(context.Background(), c, albums); files != 5 || need != 50 {
+		t.Errorf("planned %d downloads of %d bytes, want 5 of 50", files, need)
+	}
+	if server.calls != 4 {
+		t.Errorf("listed %d albums, want 4", server.calls)
+	}
+	if server.busiest != 2 {
+		t.Errorf("listed %d albums at once, want Jobs = 2", server.busiest)
+	}
+	if len(s.listings) != 5 {
+		t.Errorf("kept %d listings, want 5", len(s.listings))
+	}
+}
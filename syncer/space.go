@@ -0,0 +1,158 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// spaceMargin is how much room to leave on the disk beyond what the
+// downloads are expected to need, on top of 5% of that amount.
+const spaceMargin = 100 * 1024 * 1024
+
+// plan lists the images of every album that will be synced and works
+// out how many files will be downloaded and roughly how many bytes. The
+// listings are kept so processAlbum does not have to fetch them again.
+func (s *Syncer) plan(ctx context.Context, c *session, albums []*smugmug.AlbumInfo) (int, int64) {
+	var wanted, unlisted []*smugmug.AlbumInfo
+	for _, album := range albums {
+		updated, err := time.ParseInLocation("2006-01-02 15:04:05", album.LastUpdated, time.Local)
+		if err != nil || s.skipReason(album, updated) != "" {
+			continue
+		}
+		wanted = append(wanted, album)
+		if _, ok := s.listings[album]; !ok {
+			unlisted = append(unlisted, album)
+		}
+	}
+
+	// list the albums as many at a time as they will be synced
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	rate := make(chan struct{}, s.jobs)
+	for _, album := range unlisted {
+		rate <- struct{}{}
+		if ctx.Err() != nil {
+			<-rate
+			break
+		}
+		wg.Add(1)
+		go func(album *smugmug.AlbumInfo) {
+			defer wg.Done()
+			defer func() { <-rate }()
+			job := s.newJob()
+			defer job.flush()
+			path := s.albumPath(album)
+			var images []*smugmug.ImageInfo
+			err := job.withRetry(ctx, "listing "+path, func() error {
+				var err error
+				images, err = c.images(album)
+				return retryable(err)
+			})
+			if err != nil {
+				// processAlbum will try again and report it
+				return
+			}
+			job.checkTruncated(len(images), "images", path)
+			mu.Lock()
+			s.listings[album] = images
+			mu.Unlock()
+		}(album)
+	}
+	wg.Wait()
+
+	var files int
+	var need int64
+	for _, album := range wanted {
+		images, ok := s.listings[album]
+		if !ok {
+			continue
+		}
+		s.findDuplicates(images)
+		s.assignNumbers(images)
+		for _, image := range images {
+			if s.willDownload(album, image) {
+				files++
+				need += int64(image.Size)
+			}
+		}
+	}
+	s.expectedBytes = need
+	return files, need
+}
+
+// checkDiskSpace returns an error if need bytes will not fit on the disk
+// holding the target directory.
+func (s *Syncer) checkDiskSpace(need int64) error {
+	free, ok := diskFree(s.Dir)
+	if !ok {
+		s.debugf("Unable to find the free space in %s, not checking", s.Dir)
+		return nil
+	}
+	want := need + need/20 + spaceMargin
+	s.debugf("Expecting to download about %s with %s free", FormatSize(need), FormatSize(free))
+	if want > free {
+		return fmt.Errorf("Not enough disk space in %s: about %s will be downloaded but only %s is free (use --check-space=false to skip this check)",
+			s.Dir, FormatSize(need), FormatSize(free))
+	}
+	return nil
+}
+
+// willDownload reports whether syncFile is expected to download image,
+// making the same decisions without touching anything. Anything without
+// a local copy is counted, and so is a local copy whose cached MD5 sum
+// shows it has changed, since a changed file is downloaded beside the old
+// one before replacing it; without a cached sum, a copy of the right size
+// is taken to be current. Resized copies are counted at the size of the
+// original.
+func (s *Syncer) willDownload(album *smugmug.AlbumInfo, image *smugmug.ImageInfo) bool {
+	path, err := s.imagePath(album, image)
+	if err != nil || s.skipped(image, path) != "" {
+		return false
+	}
+	if url, _ := s.imageURL(image); url == "" {
+		return false
+	}
+	if s.DownloadOnly {
+		return true
+	}
+	var local string
+	if info, err := os.Stat(filepath.Join(s.Dir, path)); err == nil {
+		if sum, ok := s.cache.lookup(path, info); ok {
+			local = sum
+		} else if info.Size() == int64(image.Size) {
+			local = image.MD5Sum
+		} else {
+			local = "unknown"
+		}
+	}
+	switch s.localStatus(image, path, local, validators{}) {
+	case "unchanged":
+		return false
+	case "conflict":
+		return s.OnConflict != "skip" && s.OnConflict != "local"
+	}
+	return true
+}
+
+// diskFree returns the space available to us on the disk holding path.
+// path need not exist yet.
+func diskFree(path string) (int64, bool) {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return freeSpace(path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, false
+		}
+		path = parent
+	}
+}
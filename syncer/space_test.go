@@ -0,0 +1,56 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+func TestWillDownload(t *testing.T) {
+	s := newTestSyncer(t)
+	s.Protect = Patterns{"Other/Trip/keep.jpg"}
+	album := testAlbum("Trip")
+	dir := s.albumPath(album)
+	image := func(name string) *smugmug.ImageInfo {
+		return &smugmug.ImageInfo{Key: name, FileName: name, Format: "JPG", Size: 5,
+			MD5Sum: "11111111111111111111111111111111", OriginalURL: "http://example.com/" + name,
+			LastUpdated: time.Now().Add(-2 * time.Hour).Format("2006-01-02 15:04:05")}
+	}
+
+	// a local copy edited since the server's copy changed
+	writeFile(t, s.Dir, filepath.Join(dir, "edited.jpg"), "local edit")
+	noURL := image("none.jpg")
+	noURL.OriginalURL = ""
+
+	tests := []struct {
+		image      *smugmug.ImageInfo
+		onConflict string
+		want       bool
+	}{
+		{image("new.jpg"), "server", true},
+		{image("keep.jpg"), "server", false},
+		{noURL, "server", false},
+		{image("edited.jpg"), "server", true},
+		{image("edited.jpg"), "skip", false},
+		{image("edited.jpg"), "local", false},
+	}
+	for _, tt := range tests {
+		s.OnConflict = tt.onConflict
+		if got := s.willDownload(album, tt.image); got != tt.want {
+			t.Errorf("willDownload(%s) with on-conflict %s = %v, want %v", tt.image.FileName, tt.onConflict, got, tt.want)
+		}
+	}
+
+	// a copy of the right size with no cached sum is taken to be current
+	writeFile(t, s.Dir, filepath.Join(dir, "same.jpg"), "12345")
+	old := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(filepath.Join(s.Dir, dir, "same.jpg"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if s.willDownload(album, image("same.jpg")) {
+		t.Errorf("willDownload of a copy of the right size = true, want false")
+	}
+}
@@ -0,0 +1,1464 @@
+// Package syncer mirrors the albums of SmugMug accounts into a local
+// directory tree. A Syncer downloads new and changed images, skips ones
+// whose local copies already match, and optionally removes local files
+// that are no longer on the server.
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// Account is one set of SmugMug credentials. Accounts with a Name are
+// synced into a subdirectory of the target directory with that name.
+type Account struct {
+	Name     string
+	Email    string
+	APIKey   string
+	Password string
+}
+
+// Stats counts what a run did.
+type Stats struct {
+	Albums     int   `json:"albums"`      // albums processed, including ones skipped as unchanged
+	Downloaded int   `json:"downloaded"`  // files downloaded, or that would be in a dry run
+	Bytes      int64 `json:"bytes"`       // bytes in the downloaded files
+	Moved      int   `json:"moved"`       // local files moved into place instead of downloaded
+	Linked     int   `json:"linked"`      // files hard linked to identical ones instead of downloaded
+	Renumbered int   `json:"renumbered"`  // local files renamed for their new album positions
+	Deleted    int   `json:"deleted"`     // local files removed, or that would be in a dry run
+	Trashed    int   `json:"trashed"`     // local files moved to the trash
+	Dirs       int   `json:"dirs"`        // directories removed, or that would be in a dry run
+	NoOriginal int   `json:"no_original"` // images skipped because there was nothing to download
+	TooBig     int   `json:"too_big"`     // images skipped for being over MaxFileSize
+	Conflicts  int   `json:"conflicts"`   // local copies changed since the server's copy
+	Errors     int   `json:"errors"`      // errors skipped over with KeepGoing
+	Verified   int   `json:"verified"`    // files that matched the server with Verify
+	Problems   int   `json:"problems"`    // missing, changed, or extra files found with Verify
+}
+
+// Result lists what a run did with each file, along with the totals.
+// Files are in the order they were handled, which varies between runs
+// with more than one job.
+type Result struct {
+	Stats      Stats
+	Downloaded []File  // new files, including ones linked or moved into place
+	Changed    []File  // files downloaded again because they changed
+	Skipped    []File  // files left as they were, and files checked by Verify
+	Deleted    []File  // local files removed or moved to the trash
+	Failed     []File  // files that could not be synced, with Err set
+	Errors     []error // every error that was skipped over with KeepGoing
+}
+
+// File is one file handled by a run.
+type File struct {
+	Account   string // account name, if there is more than one
+	Album     string // album title, or "" if a deleted file's album cannot be told
+	AlbumPath string // album directory in the album layout, which tells apart albums with the same title
+	Path      string // relative to the account's directory
+	Size      int64
+	Status    string        // what was done, as in the manifest
+	Duration  time.Duration // time taken to download, if it was
+	Err       error
+}
+
+// Syncer holds the settings for syncing and the state of a run. Set the
+// exported fields, most conveniently starting from New, and then call Run.
+// A Syncer should not be copied or used for more than one run at a time.
+//
+// The SmugMug API client makes its requests with http.DefaultTransport,
+// which a Syncer leaves alone, so Proxy only applies to downloads; to send
+// the API requests through it too, set the default transport's Proxy to
+// the one from ProxyFunc.
+type Syncer struct {
+	// Accounts to sync. If there are none, the account given by Email,
+	// APIKey, and Password is synced straight into Dir.
+	Accounts []Account
+	Email    string
+	APIKey   string
+	Password string
+	NickName string // whose public albums to sync instead of the account's
+
+	Dir          string // target directory
+	Dry          bool   // report what would change without changing it
+	DryCheck     bool   // with Dry, check each download with a HEAD request
+	Verify       bool   // only check local files against the server
+	DownloadOnly bool   // skip the local scan and download everything
+	Delete       bool   // remove local files that are not on the server
+	PruneEmpty   bool   // remove album directories left empty
+	Fast         bool   // skip albums whose directory timestamp matches
+	Videos       bool   // download videos
+	Pics         bool   // download pictures
+	Size         string // picture size: original, x3large, ..., small
+	Hardlink     bool   // hard link identical files instead of downloading
+	ETags        bool   // ask the server whether videos and resized copies changed
+	Moves        bool   // move renamed files instead of downloading
+	OnConflict   string // server, skip, or local, for files changed locally
+	Number       bool   // prefix file names with their album position
+	IgnoreCase   bool   // treat names differing only in case as the same
+	Portable     bool   // avoid names Windows cannot use (default on Windows)
+	Layout       string // album, flat, or date
+	Template     string // path template for images, instead of Layout
+	Sidecars     bool   // save captions and keywords in .json files
+	ManifestFile string // write a JSON list of every image here
+	Jobs         int    // albums to sync at once
+	KeepGoing    bool   // count errors and carry on instead of stopping
+	Retries      int    // times to retry a failed download or listing
+	Since        time.Time
+	StartAlbum   string // title or position of the first album to sync
+
+	// Album, category, and file filters, as glob patterns. Ignore lists
+	// local files to leave alone on top of the built-in junk patterns, and
+	// Protect lists paths relative to the target directory to leave alone.
+	Albums     Patterns
+	Categories Patterns
+	Include    Patterns
+	Exclude    Patterns
+	Ignore     Patterns
+	Protect    Patterns
+
+	Privacy string // public, private, or all albums
+
+	// Separate limits, across all albums, on how many files are hashed and
+	// downloaded at once, or 0 for none. Setting either runs enough albums
+	// at once for some to be scanned while others download.
+	ScanWorkers     int
+	DownloadWorkers int
+
+	Trash            string  // move removed files under here instead
+	Force            bool    // delete past the threshold without asking
+	Threshold        bool    // a threshold is set, even if it is 0
+	ThresholdCount   int     // ask before deleting more files than this
+	ThresholdPercent float64 // or more than this percentage of an album
+
+	// Confirm is asked before deleting past the threshold. If it is nil
+	// the deletion is refused.
+	Confirm func(question string) bool
+
+	CacheFile    string        // MD5 cache (default in the target directory)
+	OutputFiles  []string      // other files the caller writes, like a log
+	TrustDirs    bool          // take unchanged directories' files from the cache
+	Checksum     string        // md5, or sha256 to record SHA-256 sums too
+	TempDir      string        // partial downloads (default beside the files)
+	CheckSpace   bool          // check for free disk space first
+	Plan         bool          // log how much will be downloaded first
+	Timeout      time.Duration // connect and response header timeout
+	FileTimeout  time.Duration // give up on a single file after this long
+	Proxy        string        // proxy URL for downloads (default from the environment)
+	PerHost      int           // downloads at once from one host
+	MaxBandwidth int64         // combined bytes per second, or 0
+	MaxFileSize  int64         // skip images bigger than this, or 0
+
+	Verbosity Level
+	Logger    *log.Logger // default is the standard logger
+
+	// Events, if set, is called with each event as it happens.
+	Events func(Event)
+
+	// state of the current run, starting with the settings above that
+	// prepare adjusts for it
+	jobs                              int
+	deleting, fast, moves, checkSpace bool
+
+	mu           sync.Mutex // guards stats, result, and the progress counters
+	stats        Stats
+	result       Result
+	eventsMu     sync.Mutex // keeps events in order
+	promptMu     sync.Mutex // keeps jobs from asking at once or logging over a question
+	trash        string
+	cacheFile    string
+	cache        *md5Cache
+	outputs      map[string]bool // absolute paths of files we write
+	inventory    manifest
+	saved        *md5Index    // local copies of images, for Hardlink
+	orphans      *orphanIndex // local files no image claims, for Moves
+	flatFiles    *fileSet     // the shared scan in the flat layout
+	foldCase     bool         // ignore case in local file names
+	pathTemplate *template.Template
+	listings     map[*smugmug.AlbumInfo][]*smugmug.ImageInfo
+	removedDirs  map[string]bool // by cleanup, so they are not pruned again
+	templateDirs map[string]bool // where the template put images, guarded by mu
+	dirs         dirCache        // directories made, so each is made once
+	accountName  string
+
+	flatPrefixes map[*smugmug.AlbumInfo]string
+	numbers      numberIndex
+	duplicates   duplicateIndex
+	bandwidth    *limiter
+	hosts        *hostLimiter
+	hashing      pool // files being hashed, for ScanWorkers
+	downloads    pool // files being downloaded, for DownloadWorkers
+	client       *http.Client
+
+	// progress through the albums, for the running totals
+	syncStart     time.Time
+	albumsDone    int
+	expectedBytes int64
+	startFiles    int
+	startBytes    int64
+}
+
+// New returns a Syncer with the same defaults as the command.
+func New() *Syncer {
+	return &Syncer{
+		Dir:        ".",
+		Delete:     true,
+		Fast:       true,
+		Videos:     true,
+		Pics:       true,
+		Size:       "original",
+		Moves:      true,
+		OnConflict: "server",
+		Checksum:   "md5",
+		Portable:   runtime.GOOS == "windows",
+		Privacy:    "all",
+		Layout:     "album",
+		Jobs:       1,
+		Retries:    3,
+		CheckSpace: true,
+		Timeout:    time.Minute,
+		PerHost:    4,
+		Verbosity:  Normal,
+	}
+}
+
+// Stats returns the totals so far. It may be called while Run is going.
+func (s *Syncer) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// TrashDir returns the timestamped directory removed files are moved to,
+// once Run has started.
+func (s *Syncer) TrashDir() string {
+	return s.trash
+}
+
+// prepare checks the settings and sets up what a run or scan needs.
+func (s *Syncer) prepare(start time.Time) error {
+	if s.Layout != "album" && s.Layout != "flat" && s.Layout != "date" {
+		return fmt.Errorf("Unknown layout %q", s.Layout)
+	}
+	s.pathTemplate = nil
+	if s.Layout == "date" {
+		if s.Template != "" {
+			return fmt.Errorf("Only one of a template and the %s layout can be set", s.Layout)
+		}
+		t, err := parseTemplate(DateTemplate)
+		if err != nil {
+			return err
+		}
+		s.pathTemplate = t
+	}
+	if s.Template != "" {
+		if s.Layout != "album" {
+			return fmt.Errorf("Only one of a template and the %s layout can be set", s.Layout)
+		}
+		t, err := parseTemplate(s.Template)
+		if err != nil {
+			return err
+		}
+		s.pathTemplate = t
+	}
+	if _, ok := sizeURLs[s.Size]; !ok {
+		return fmt.Errorf("Unknown picture size %q", s.Size)
+	}
+	switch s.Privacy {
+	case "", "all", "public", "private":
+	default:
+		return fmt.Errorf("Unknown privacy %q", s.Privacy)
+	}
+	if _, ok := checksums[s.Checksum]; !ok && s.Checksum != "" {
+		return fmt.Errorf("Unknown checksum algorithm %q", s.Checksum)
+	}
+	switch s.OnConflict {
+	case "", "server", "skip", "local":
+	default:
+		return fmt.Errorf("Unknown conflict policy %q", s.OnConflict)
+	}
+	// the settings below are adjusted for this run only, so they are
+	// copied rather than changed where the caller set them
+	s.jobs, s.deleting, s.fast, s.moves, s.checkSpace = s.Jobs, s.Delete, s.Fast, s.Moves, s.CheckSpace
+	if s.jobs < 1 {
+		s.jobs = 1
+	}
+	// with separate pools, enough albums have to run at once for one to
+	// be scanned while others download
+	if s.ScanWorkers > 0 || s.DownloadWorkers > 0 {
+		if n := s.ScanWorkers + s.DownloadWorkers; s.jobs < n {
+			s.jobs = n
+		}
+	}
+	s.hashing = newPool(s.ScanWorkers)
+	s.downloads = newPool(s.DownloadWorkers)
+	if s.DownloadOnly {
+		if s.Verify {
+			return fmt.Errorf("Only one of verify and download-only can be set")
+		}
+		// without a scan every local file would look like an extra one
+		s.deleting = false
+		s.moves = false
+	}
+	if s.Verify {
+		// every file is checked and nothing is changed
+		s.fast = false
+		s.deleting = false
+		s.moves = false
+		s.checkSpace = false
+	}
+	if s.NickName != "" && len(s.Accounts) > 1 {
+		return fmt.Errorf("Only one account can be used to sync another user's albums")
+	}
+	if s.StartAlbum != "" && s.deleting {
+		// the albums skipped over would look like they had been deleted
+		// to a cleanup of the whole directory
+		return fmt.Errorf("Starting at an album can only be done with delete turned off")
+	}
+
+	proxy, err := ProxyFunc(s.Proxy)
+	if err != nil {
+		return err
+	}
+	s.client = newClient(s.Timeout, proxy)
+	s.hosts = newHostLimiter(s.PerHost)
+	if s.MaxBandwidth > 0 {
+		s.bandwidth = newLimiter(s.MaxBandwidth)
+	}
+
+	d, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return fmt.Errorf("Unable to find absolute path for %s: %v", s.Dir, err)
+	}
+	s.Dir = d
+	s.trash = ""
+	if s.Trash != "" {
+		t, err := filepath.Abs(s.Trash)
+		if err != nil {
+			return fmt.Errorf("Unable to find absolute path for %s: %v", s.Trash, err)
+		}
+		s.trash = filepath.Join(t, start.Format("2006-01-02T15-04-05"))
+	}
+	if s.TempDir != "" {
+		if err := os.MkdirAll(s.TempDir, 0755); err != nil {
+			return fmt.Errorf("Unable to create temporary directory %s: %v", s.TempDir, err)
+		}
+	}
+	s.saved = newIndex()
+	s.orphans = newOrphanIndex()
+	s.dirs.made = make(map[string]bool)
+	s.flatPrefixes = make(map[*smugmug.AlbumInfo]string)
+	s.numbers.prefixes = make(map[*smugmug.ImageInfo]string)
+	s.duplicates.images = make(map[*smugmug.ImageInfo]bool)
+	// the scan compares the paths it walks against the cache file's, and
+	// those are absolute
+	s.cacheFile = filepath.Join(s.Dir, ".smugsync-cache.json")
+	if s.CacheFile != "" {
+		c, err := filepath.Abs(s.CacheFile)
+		if err != nil {
+			return fmt.Errorf("Unable to find absolute path for %s: %v", s.CacheFile, err)
+		}
+		s.cacheFile = c
+	}
+	// our own output files may be in the target directory, but they are
+	// not images and are never deleted
+	s.outputs = make(map[string]bool)
+	for _, f := range append([]string{s.ManifestFile}, s.OutputFiles...) {
+		if f == "" {
+			continue
+		}
+		p, err := filepath.Abs(f)
+		if err != nil {
+			return fmt.Errorf("Unable to find absolute path for %s: %v", f, err)
+		}
+		s.outputs[p] = true
+	}
+	return nil
+}
+
+// ProxyFunc returns the proxy function for an http.Transport that sends
+// requests through proxy, an HTTP, HTTPS, or SOCKS5 URL, or that takes the
+// proxy from the environment if it is "".
+func ProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy %q", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q", u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// Run syncs every account and returns what it did. Cancelling ctx stops
+// the run cleanly: downloads in progress are abandoned (and resumed next
+// time) and nothing more is cleaned up. Unless KeepGoing is set, the first
+// error stops the run and is returned along with what was done before it.
+func (s *Syncer) Run(ctx context.Context) (*Result, error) {
+	// the target directory is made absolute for the run, and then each
+	// account's is used in turn; the caller gets back the one they set
+	defer func(dir string) { s.Dir = dir }(s.Dir)
+	s.reset()
+	if err := s.prepare(time.Now()); err != nil {
+		s.emit(Event{Type: "error", Error: err.Error()})
+		return s.finish(), err
+	}
+
+	root, trashRoot, cacheRoot := s.Dir, s.trash, ""
+	if s.CacheFile != "" {
+		cacheRoot = s.cacheFile
+	}
+	defer func() { s.trash = trashRoot }()
+	for _, a := range s.accounts() {
+		if ctx.Err() != nil {
+			break
+		}
+		s.Dir = filepath.Join(root, a.Name)
+		if trashRoot != "" {
+			s.trash = filepath.Join(trashRoot, a.Name)
+		}
+		s.cacheFile = cacheRoot
+		if s.cacheFile != "" && a.Name != "" {
+			ext := filepath.Ext(s.cacheFile)
+			s.cacheFile = strings.TrimSuffix(s.cacheFile, ext) + "-" + a.Name + ext
+		}
+		if a.Name != "" {
+			s.infof("Syncing account %s into %s", a.Name, s.Dir)
+		}
+		if err := s.syncAccount(ctx, a); err != nil && ctx.Err() == nil {
+			if !s.KeepGoing {
+				s.emit(Event{Type: "error", Error: err.Error()})
+				s.saveManifest(false)
+				return s.finish(), err
+			}
+			s.countError(err)
+		}
+	}
+	s.saveManifest(ctx.Err() == nil)
+	return s.finish(), nil
+}
+
+// saveManifest writes out the manifest, if there is to be one. A run that
+// stopped part way still saves what it got to, with a warning that the
+// manifest is not complete.
+func (s *Syncer) saveManifest(complete bool) {
+	if s.ManifestFile == "" {
+		return
+	}
+	if err := s.inventory.save(s.ManifestFile); err != nil {
+		s.warnf("Unable to save manifest: %v", err)
+	} else if !complete {
+		s.warnf("WARNING: the run stopped part way, so %s only lists the images seen before then", s.ManifestFile)
+	}
+}
+
+// reset clears what an earlier run left behind, so that a Syncer can be
+// run more than once.
+func (s *Syncer) reset() {
+	s.mu.Lock()
+	s.stats, s.result = Stats{}, Result{}
+	s.albumsDone, s.expectedBytes, s.startFiles, s.startBytes = 0, 0, 0, 0
+	s.mu.Unlock()
+	s.inventory.Lock()
+	s.inventory.entries = nil
+	s.inventory.Unlock()
+	s.cache, s.flatFiles, s.bandwidth = nil, nil, nil
+	s.listings, s.removedDirs, s.templateDirs, s.accountName = nil, nil, nil, ""
+}
+
+// accounts returns the accounts to sync: each is synced into its own
+// directory, or straight into the target directory if there is only the
+// one from Email.
+func (s *Syncer) accounts() []Account {
+	if len(s.Accounts) > 0 {
+		return s.Accounts
+	}
+	return []Account{{Email: s.Email, APIKey: s.APIKey, Password: s.Password}}
+}
+
+// finish returns the result of the run so far, and sends it as the
+// summary event.
+func (s *Syncer) finish() *Result {
+	s.mu.Lock()
+	r := s.result
+	r.Stats = s.stats
+	s.mu.Unlock()
+	s.emit(Event{Type: "summary", Stats: &r.Stats})
+	return &r
+}
+
+// Scan hashes the files under the target directory and returns their MD5
+// sums by path relative to it. Directories map to "directory". The MD5
+// cache is used but not updated.
+func (s *Syncer) Scan() (map[string]string, error) {
+	defer func(dir string) { s.Dir = dir }(s.Dir)
+	if err := s.prepare(time.Now()); err != nil {
+		return nil, err
+	}
+	s.loadCache()
+	files := newFileSet(s.IgnoreCase || caseInsensitive(s.Dir, false))
+	if err := s.scan(context.Background(), s.Dir, true, files); err != nil {
+		return nil, err
+	}
+	return files.entries(), nil
+}
+
+// syncAccount logs in to one account and syncs all of its albums into dir.
+func (s *Syncer) syncAccount(ctx context.Context, a Account) error {
+	if s.cacheFile == "" {
+		s.cacheFile = filepath.Join(s.Dir, ".smugsync-cache.json")
+	}
+	if s.Verify {
+		s.cache = &md5Cache{entries: make(map[string]cacheEntry), algorithm: s.checksumAlgorithm()}
+	} else {
+		s.loadCache()
+		// the sums found so far are kept even if the run fails
+		defer func() {
+			if err := s.saveCache(); err != nil {
+				s.warnf("Unable to save cache: %v", err)
+			}
+		}()
+	}
+	s.orphans = newOrphanIndex()
+	s.listings = make(map[*smugmug.AlbumInfo][]*smugmug.ImageInfo)
+	s.removedDirs = make(map[string]bool)
+	s.templateDirs = make(map[string]bool)
+	s.accountName = a.Name
+	errorsBefore := s.stats.Errors
+	s.foldCase = s.IgnoreCase
+	if !s.foldCase && caseInsensitive(s.Dir, !s.Dry && !s.Verify) {
+		s.debugf("%s is on a case-insensitive file system, ignoring case in file names", s.Dir)
+		s.foldCase = true
+	}
+
+	// login
+	c, err := s.login(a)
+	if err != nil {
+		return err
+	}
+	s.infof("Logged in %s, NickName is %s", a.Email, c.nickName())
+	if s.NickName != "" {
+		s.infof("Syncing the public albums of %s", s.NickName)
+	}
+
+	// get full list of albums
+	var albums []*smugmug.AlbumInfo
+	err = s.withRetry(ctx, "listing albums", func() error {
+		var err error
+		albums, err = c.albums(s.NickName)
+		return retryable(err)
+	})
+	if err != nil {
+		return fmt.Errorf("Albums error: %v", err)
+	}
+	s.infof("Found %d albums", len(albums))
+	all := albums
+	s.checkTruncated(len(albums), "albums", "")
+	if s.Layout == "flat" {
+		s.assignFlatPrefixes(albums)
+	}
+
+	// files outside of every album may be ones the server has moved
+	if s.moves {
+		if err := s.findStrays(albums); err != nil {
+			return fmt.Errorf("Error scanning for moved files: %v", err)
+		}
+	}
+
+	// filter the list; each album's cleanup only looks inside its own
+	// directory, so local copies of albums left out here are not touched
+	if s.filteringAlbums() {
+		var matched []*smugmug.AlbumInfo
+		for _, album := range albums {
+			if s.wantAlbum(album) {
+				matched = append(matched, album)
+			}
+		}
+		s.infof("Syncing %d albums that match the filters", len(matched))
+		albums = matched
+	}
+	filtered := s.filteringAlbums()
+
+	// pick up where an earlier run left off
+	var passed []*smugmug.AlbumInfo
+	if s.StartAlbum != "" {
+		i, err := startIndex(albums, s.StartAlbum)
+		if err != nil {
+			return err
+		}
+		s.infof("Starting at album %d, %s, skipping %d albums", i+1, s.albumPath(albums[i]), i)
+		passed, albums = albums[:i], albums[i:]
+		filtered = true
+	}
+
+	// in the flat layout every album's files are in the same place, and
+	// with a template they can be anywhere, so they are scanned once up
+	// front
+	flatScanned := 0
+	if s.shared() {
+		s.flatFiles = newFileSet(s.foldCase)
+		if err := s.scan(ctx, s.Dir, s.Layout != "flat", s.flatFiles); err != nil {
+			return fmt.Errorf("Error walking local file system: %v", err)
+		}
+		flatScanned = s.flatFiles.count()
+	}
+
+	// in the date layout files from different albums can land in the same
+	// place, which can only be seen with every listing in hand
+	if s.Layout == "date" {
+		s.findDateCollisions(ctx, c, all)
+	}
+
+	// work out what is to be downloaded, and make sure it will fit before
+	// filling the disk halfway
+	checkSpace := s.checkSpace && !s.Dry
+	if checkSpace || s.Plan {
+		if checkSpace {
+			s.infof("Checking for free disk space")
+		}
+		files, need := s.plan(ctx, c, albums)
+		if s.Plan {
+			s.logf("Planning to download %d files, %s", files, FormatSize(need))
+		}
+		if checkSpace && ctx.Err() == nil {
+			if err := s.checkDiskSpace(need); err != nil {
+				return err
+			}
+		}
+	}
+
+	// process each album
+	s.mu.Lock()
+	s.syncStart, s.albumsDone, s.startFiles, s.startBytes = time.Now(), 0, s.stats.Downloaded, s.stats.Bytes
+	s.mu.Unlock()
+	// the first failure stops the other jobs unless we are keeping going
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failure error
+	rate := make(chan struct{}, s.jobs)
+	for i, album := range albums {
+		rate <- struct{}{}
+		if jobCtx.Err() != nil {
+			<-rate
+			break
+		}
+		go func(i int, album *smugmug.AlbumInfo) {
+			job := s.newJob()
+			err := job.processAlbum(jobCtx, c, album, i+1, len(albums))
+			if err != nil && jobCtx.Err() == nil {
+				if s.KeepGoing {
+					job.countError(fmt.Errorf("Error processing album %s: %v", album.URL, err))
+				} else {
+					s.mu.Lock()
+					if failure == nil {
+						failure = fmt.Errorf("Error processing album %s: %v", album.URL, err)
+					}
+					s.mu.Unlock()
+					cancel()
+				}
+			}
+			job.flush()
+			s.mu.Lock()
+			s.albumsDone++
+			s.stats.Albums++
+			s.mu.Unlock()
+			<-rate
+		}(i, album)
+	}
+
+	// wait for remaining jobs to finish
+	for i := 0; i < s.jobs; i++ {
+		rate <- struct{}{}
+	}
+	if failure != nil {
+		return failure
+	}
+
+	// the albums before the starting one are still in the manifest
+	if len(passed) > 0 && s.ManifestFile != "" {
+		job := s.newJob()
+		job.held = false
+		for _, album := range passed {
+			if ctx.Err() != nil {
+				break
+			}
+			job.recordUnsynced(ctx, c, album)
+		}
+	}
+
+	// the shared file set can only be cleaned up once all the albums are
+	// done, and only if all of them were
+	if s.shared() && ctx.Err() == nil {
+		job := s.newJob()
+		job.held = false
+		if s.Layout == "flat" {
+			s.keepForeign(s.flatFiles)
+		} else {
+			s.keepOutsideTemplate(s.flatFiles)
+		}
+		switch {
+		case s.Verify:
+			// extras can only be told apart when every album was listed
+			if s.stats.Errors == errorsBefore && !filtered {
+				job.reportExtras(s.flatFiles)
+			}
+		case s.stats.Errors > errorsBefore:
+			s.warnf("Not cleaning up since some albums failed")
+		case filtered:
+			s.warnf("Not cleaning up since only some albums were synced")
+		default:
+			if err := job.cleanup(s.flatFiles, flatScanned); err != nil {
+				s.countError(fmt.Errorf("Error cleaning up: %v", err))
+			}
+		}
+	}
+
+	if s.PruneEmpty && !s.Verify && !s.shared() && ctx.Err() == nil {
+		if err := s.pruneEmptyAlbums(all); err != nil {
+			s.countError(fmt.Errorf("Error removing empty albums: %v", err))
+		}
+	}
+	return nil
+}
+
+// saveCache writes the cache file. Saving it adds a file to its directory
+// and so would change the directory's modification time, and with
+// TrustDirs that directory would be scanned on every run; if nothing else
+// has changed there since its last full scan, it gets its old time back.
+func (s *Syncer) saveCache() error {
+	dir := filepath.Dir(s.cacheFile)
+	before, err := os.Stat(dir)
+	rel, rerr := filepath.Rel(s.Dir, dir)
+	unchanged := s.TrustDirs && err == nil && rerr == nil && s.cache.unchangedDir(rel, before)
+	if err := s.cache.save(s.cacheFile); err != nil {
+		return err
+	}
+	if unchanged {
+		if err := os.Chtimes(dir, time.Now(), before.ModTime()); err != nil {
+			s.debugf("Unable to keep the modification time of %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// startIndex returns the index in albums of the album given by start,
+// which is either its title or its position in the list counting from 1.
+func startIndex(albums []*smugmug.AlbumInfo, start string) (int, error) {
+	for i, album := range albums {
+		if album.Title == start {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(start); err == nil {
+		if n < 1 || n > len(albums) {
+			return 0, fmt.Errorf("Start album %d is out of range, there are %d albums", n, len(albums))
+		}
+		return n - 1, nil
+	}
+	return 0, fmt.Errorf("No album titled %q to start at", start)
+}
+
+// findStrays adds the files that lie outside the directories of all the
+// albums on the server (or, in the flat layout, that do not belong to any
+// album) to the orphan index. These are usually what is left
+// of an album that was renamed or moved to another category. They are
+// never deleted, but their contents can be moved into a new album instead
+// of being downloaded again. Only files an earlier sync scanned, and so
+// has in its cache, are considered; anything else in the target directory
+// is not ours to move. Directories that cannot be read are skipped.
+func (s *Syncer) findStrays(albums []*smugmug.AlbumInfo) error {
+	// every file under the target directory could belong to an image
+	// with a template, so none of them are strays
+	if s.pathTemplate != nil {
+		return nil
+	}
+	albumDirs := make(map[string]bool)
+	if s.Layout == "album" {
+		for _, album := range albums {
+			albumDirs[s.albumPath(album)] = true
+		}
+	}
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == s.Dir {
+				return err
+			}
+			s.warnf("WARNING: skipping %s while looking for moved files: %v", path, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		if path != s.Dir && s.ignored(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if albumDirs[rel] || (s.trash != "" && path == filepath.Dir(s.trash)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == s.cacheFile || strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		if s.Layout == "flat" && filepath.Dir(rel) == "." && s.hasFlatPrefix(rel) {
+			return nil
+		}
+
+		if sum, ok := s.cache.lookup(rel, info); ok {
+			s.orphans.add(sum, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// pageSizes are listing lengths that suggest the server stopped at the end
+// of a page rather than at the end of the list.
+var pageSizes = map[int]bool{100: true, 200: true, 250: true, 500: true, 1000: true, 2000: true, 5000: true, 10000: true}
+
+// checkTruncated warns when a listing has a suspiciously round length. The
+// smugmug client asks for whole listings and has no way to page through
+// them, so if the server ever truncates one we cannot fetch the rest, and
+// whatever is missing would look like it had been deleted.
+func (s *albumJob) checkTruncated(n int, what, where string) {
+	truncated(n, what, where, s.warnf)
+}
+
+// checkTruncated is the same for listings made outside of any album.
+func (s *Syncer) checkTruncated(n int, what, where string) {
+	truncated(n, what, where, s.warnf)
+}
+
+// truncated does the work of checkTruncated, warning with warnf.
+func truncated(n int, what, where string, warnf func(string, ...interface{})) {
+	if !pageSizes[n] {
+		return
+	}
+	if where != "" {
+		where = " in " + where
+	}
+	warnf("WARNING: the server listed exactly %d %s%s, which may mean the listing was cut short. "+
+		"Anything missing from it will be deleted locally; consider --dry or --delete-threshold.", n, what, where)
+}
+
+// skipReason returns why album can be skipped without listing its images,
+// or "" if it needs to be synced.
+func (s *Syncer) skipReason(album *smugmug.AlbumInfo, updated time.Time) string {
+	if !s.Since.IsZero() && updated.Before(s.Since) {
+		return "not updated since " + s.Since.Format("2006-01-02")
+	}
+	if s.fast && !s.shared() {
+		info, err := os.Stat(filepath.Join(s.Dir, s.albumPath(album)))
+		if err == nil && info.IsDir() && info.ModTime().Equal(updated) {
+			return "timestamp of " + album.LastUpdated + " matches"
+		}
+	}
+	return ""
+}
+
+// keepForeign keeps the files in the flat layout's shared scan that no
+// album could have saved. Every image is saved with its album's prefix,
+// so anything else in the target directory was put there by someone else.
+func (s *Syncer) keepForeign(localFiles *fileSet) {
+	for k, v := range localFiles.entries() {
+		if v != "directory" && !s.hasFlatPrefix(k) {
+			localFiles.keep(k)
+		}
+	}
+}
+
+// addTemplateDirs notes the directories the path template puts album's
+// images in.
+func (s *Syncer) addTemplateDirs(album *smugmug.AlbumInfo, images []*smugmug.ImageInfo) {
+	var dirs []string
+	for _, img := range images {
+		if p, err := s.imagePath(album, img); err == nil {
+			dirs = append(dirs, filepath.Dir(p))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range dirs {
+		s.templateDirs[d] = true
+	}
+}
+
+// keepOutsideTemplate keeps what is in the shared scan with a template
+// but not in or under a directory it put an image in. Like the album
+// layout, which only cleans up inside album directories, this leaves
+// alone files kept beside the synced ones, and those of albums that are
+// no longer on the server.
+func (s *Syncer) keepOutsideTemplate(localFiles *fileSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range localFiles.entries() {
+		p := filepath.Dir(k)
+		if v == "directory" {
+			p = k
+		}
+		for !s.templateDirs[p] && p != "." {
+			p = filepath.Dir(p)
+		}
+		if !s.templateDirs[p] {
+			localFiles.keep(k)
+		}
+	}
+}
+
+// albumFiles returns the files in localFiles that belong to album. With a
+// template there is no telling which album a file belongs to without its
+// listing, so every file is returned.
+func (s *Syncer) albumFiles(localFiles *fileSet, album *smugmug.AlbumInfo) []string {
+	var files []string
+	for k, v := range localFiles.entries() {
+		if v != "directory" && (s.Layout != "flat" || strings.HasPrefix(k, s.flatPrefixes[album])) {
+			files = append(files, k)
+		}
+	}
+	return files
+}
+
+func (s *albumJob) processAlbum(ctx context.Context, c *session, album *smugmug.AlbumInfo, n, total int) error {
+	path := s.albumPath(album)
+	s.album, s.dir = album.Title, path
+	fullpath := filepath.Join(s.Dir, path)
+	updated, err := time.ParseInLocation("2006-01-02 15:04:05", album.LastUpdated, time.Local)
+	if err != nil {
+		return fmt.Errorf("Unable to parse timestamp %q: %v", album.LastUpdated, err)
+	}
+
+	// see if we can skip this based on a time stamp
+	flat := s.shared()
+	if reason := s.skipReason(album, updated); reason != "" {
+		s.debugf("Skipping %s [%s], %s", path, album.URL, reason)
+		if flat {
+			for _, k := range s.albumFiles(s.flatFiles, album) {
+				s.flatFiles.keep(k)
+			}
+		}
+		s.recordUnsynced(ctx, c, album)
+		return nil
+	}
+
+	s.infof("Processing %s [%s] (updated %s), album %d of %d", path, album.URL, album.LastUpdated, n, total)
+	s.emit(Event{Type: "album_started", Album: album.Title, Path: path})
+	if p := s.progress(total); p != "" {
+		s.infof("%s", p)
+	}
+	albumStart := time.Now()
+	defer func() {
+		s.debugf("Finished %s in %v", path, time.Since(albumStart))
+	}()
+
+	// scan the local directory: map path to md5sum
+	localFiles := s.flatFiles
+	scanned := 0
+	if !flat {
+		localFiles = newFileSet(s.foldCase)
+		if err := s.scan(ctx, fullpath, true, localFiles); err != nil {
+			return fmt.Errorf("error walking local file system: %v", err)
+		}
+		scanned = localFiles.count()
+	}
+
+	// get full list of images from this album
+	images, ok := s.listings[album]
+	if !ok {
+		err = s.withRetry(ctx, "listing "+path, func() error {
+			var err error
+			images, err = c.images(album)
+			return retryable(err)
+		})
+		if err != nil {
+			return fmt.Errorf("Images error: %v", err)
+		}
+		s.checkTruncated(len(images), "images", path)
+	}
+	s.findDuplicates(images)
+	s.assignNumbers(images)
+	if s.pathTemplate != nil {
+		s.addTemplateDirs(album, images)
+	}
+
+	// an empty listing for an album we have files for is more likely to be
+	// an API problem than an album that was really emptied, so leave the
+	// files alone (and the timestamp too, so it is checked again next time)
+	if len(images) == 0 && s.deleting && !s.Force {
+		if mine := s.albumFiles(localFiles, album); len(mine) > 0 {
+			s.warnf("WARNING: the server listed no images in %s, but there are %d local files; use --force to delete them", path, len(mine))
+			for _, k := range mine {
+				localFiles.keep(k)
+			}
+			return nil
+		}
+	}
+
+	// renumbered images only need renaming
+	if err := s.renumber(album, images, localFiles); err != nil {
+		return err
+	}
+
+	// local files that no image claims may have been renamed on the server
+	if s.moves && !flat {
+		claimed := make(map[string]bool)
+		for _, img := range images {
+			if p, err := s.imagePath(album, img); err == nil {
+				claimed[p] = true
+			}
+		}
+		for k, v := range localFiles.entries() {
+			if v != "directory" && !claimed[k] {
+				s.orphans.add(v, filepath.Join(s.Dir, k))
+			}
+		}
+	}
+
+	// process each image
+	failed := false
+	for _, img := range images {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := s.syncFile(ctx, album, img, localFiles); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err = fmt.Errorf("Error processing image %s from album %s in category %s: %v",
+				img.FileName, album.Title, album.Category.Name, err)
+			if !s.KeepGoing {
+				return err
+			}
+			s.countError(err)
+			failed = true
+		}
+	}
+
+	// anything that failed to download would look like an extra local file,
+	// and leaving the timestamp alone makes sure we try again next time
+	if failed {
+		s.warnf("Not cleaning up %s since some images failed", path)
+		return nil
+	}
+	if flat {
+		return nil
+	}
+	if s.Verify {
+		s.reportExtras(localFiles)
+		return nil
+	}
+
+	// delete extra files
+	if err = s.cleanup(localFiles, scanned); err != nil {
+		return fmt.Errorf("Error cleaning up: %v", err)
+	}
+
+	// update the directory timestamp to match (if every image was skipped
+	// there may be no directory). With --since the older images were not
+	// looked at, so the album cannot be considered up to date.
+	if _, err := os.Stat(fullpath); err == nil && !s.Dry && s.Since.IsZero() {
+		if err = os.Chtimes(fullpath, updated, updated); err != nil {
+			return fmt.Errorf("failed to set timestamp on directory %s: %v", fullpath, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanup removes the entries left in localFiles, which are the files and
+// directories in an album that are no longer on the server. scanned is the
+// number of files that were found in the album to begin with.
+func (s *albumJob) cleanup(localFiles *fileSet, scanned int) error {
+	if !s.deleting {
+		return nil
+	}
+	leftover := localFiles.entries()
+
+	// a partial listing from the server can make everything look like it
+	// needs to go, so get confirmation before deleting a lot
+	var files []string
+	for k, v := range leftover {
+		if v != "directory" {
+			files = append(files, k)
+		}
+	}
+	if !s.Dry && !s.Force && s.overThreshold(len(files), scanned) {
+		sort.Strings(files)
+		s.promptMu.Lock()
+		s.warnf("About to delete %d of %d files:", len(files), scanned)
+		for _, k := range files {
+			s.warnf("    %s", k)
+		}
+		// the question needs the album's messages so far for context
+		s.flushLocked()
+		ok := s.Confirm != nil && s.Confirm(fmt.Sprintf("Delete these %d files?", len(files)))
+		s.promptMu.Unlock()
+		if !ok {
+			return fmt.Errorf("refusing to delete %d files past the delete threshold without --force", len(files))
+		}
+	}
+
+	// delete local file not found on server
+	removedFiles, trashedFiles, removedDirs := 0, 0, 0
+	for k, v := range leftover {
+		if v == "directory" {
+			continue
+		}
+		fullpath := filepath.Join(s.Dir, k)
+		var size int64
+		if info, err := os.Lstat(fullpath); err == nil {
+			size = info.Size()
+		}
+		if s.Dry {
+			s.infof("dry run, not removing file %s", k)
+			s.countRemoval(k, size, false)
+			removedFiles++
+		} else if s.trash != "" {
+			dest := filepath.Join(s.trash, k)
+			if err := s.dirs.mkdirAll(filepath.Dir(dest)); err != nil {
+				return err
+			}
+			if err := renameFile(fullpath, dest); os.IsNotExist(err) {
+				// already moved into another album
+				continue
+			} else if err != nil {
+				return fmt.Errorf("error moving file %s to %s: %v", fullpath, dest, err)
+			}
+			s.cache.remove(k)
+			s.countRemoval(k, size, true)
+			trashedFiles++
+		} else {
+			if err := os.Remove(fullpath); os.IsNotExist(err) {
+				// already moved into another album
+				continue
+			} else if err != nil {
+				return fmt.Errorf("error removing file %s: %v", fullpath, err)
+			}
+			s.cache.remove(k)
+			s.countRemoval(k, size, false)
+			removedFiles++
+		}
+	}
+
+	// delete directories found but not used, deepest first so that each
+	// one has been emptied by the time we get to it
+	var dirs []string
+	for k, v := range leftover {
+		if v == "directory" {
+			dirs = append(dirs, k)
+		}
+	}
+	sortDeepestFirst(dirs)
+	for _, k := range dirs {
+		if s.Dry {
+			s.infof("dry run, not removing directory %s", k)
+			s.countDir(k)
+			removedDirs++
+			continue
+		}
+		fullpath := filepath.Join(s.Dir, k)
+		entries, err := os.ReadDir(fullpath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading directory %s: %v", fullpath, err)
+		}
+		if len(entries) > 0 {
+			// ignored files are never removed, so they can keep a
+			// directory around
+			s.debugf("not removing directory %s, it is not empty", k)
+			continue
+		}
+		if err := os.Remove(fullpath); err != nil {
+			return fmt.Errorf("error removing directory %s: %v", fullpath, err)
+		}
+		s.countDir(k)
+		removedDirs++
+	}
+
+	switch {
+	case s.Dry && (removedFiles > 0 || removedDirs > 0):
+		s.infof("dry run, would remove %d files and %d directories", removedFiles, removedDirs)
+	case trashedFiles > 0:
+		s.infof("moved %d files to the trash and removed %d directories", trashedFiles, removedDirs)
+	case removedFiles > 0 || removedDirs > 0:
+		s.infof("removed %d files and %d directories", removedFiles, removedDirs)
+	}
+
+	return nil
+}
+
+// sortDeepestFirst sorts directories so that each one comes before the
+// directory holding it.
+func sortDeepestFirst(dirs []string) {
+	sort.Slice(dirs, func(i, j int) bool {
+		di := strings.Count(dirs[i], string(filepath.Separator))
+		dj := strings.Count(dirs[j], string(filepath.Separator))
+		if di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+}
+
+// pruneEmptyAlbums removes the directories of albums that hold nothing but
+// empty directories, and then any category and subcategory directories
+// left empty. Only the directories that albums on the server map to are
+// looked at, so empty directories anyone else made are left alone, and
+// ones cleanup has already dealt with are skipped. In a dry run they are
+// only listed.
+func (s *Syncer) pruneEmptyAlbums(albums []*smugmug.AlbumInfo) error {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, album := range albums {
+		for p := s.albumPath(album); p != "." && !seen[p]; p = filepath.Dir(p) {
+			seen[p] = true
+			dirs = append(dirs, p)
+		}
+	}
+	sortDeepestFirst(dirs)
+
+	pruned := 0
+	for _, k := range dirs {
+		s.mu.Lock()
+		done := s.removedDirs[k]
+		s.mu.Unlock()
+		if done {
+			continue
+		}
+		fullpath := filepath.Join(s.Dir, k)
+		empty, err := emptyTree(fullpath)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			continue
+		}
+		if s.Dry {
+			s.infof("dry run, not removing empty directory %s", k)
+		} else {
+			if err := os.RemoveAll(fullpath); err != nil {
+				return fmt.Errorf("error removing directory %s: %v", fullpath, err)
+			}
+			s.debugf("removed empty directory %s", k)
+		}
+		s.countDir(k)
+		pruned++
+	}
+	if pruned > 0 && !s.Dry {
+		s.infof("removed %d empty directories", pruned)
+	}
+	return nil
+}
+
+// emptyTree reports whether dir exists and holds no files, only empty
+// directories if anything.
+func emptyTree(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error reading directory %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			return false, nil
+		}
+		if empty, err := emptyTree(filepath.Join(dir, e.Name())); err != nil || !empty {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// overThreshold reports whether deleting n of the total files in an album
+// exceeds the delete threshold. A threshold of 0 set with Threshold means
+// asking before any deletion at all.
+func (s *Syncer) overThreshold(n, total int) bool {
+	switch {
+	case s.ThresholdCount > 0:
+		return n > s.ThresholdCount
+	case s.ThresholdPercent > 0 && total > 0:
+		return float64(n)*100/float64(total) > s.ThresholdPercent
+	case s.Threshold:
+		return n > 0
+	}
+	return false
+}
+
+// loadCache loads the MD5 cache for the current account.
+func (s *Syncer) loadCache() {
+	c, err := loadCache(s.cacheFile)
+	if err != nil {
+		s.warnf("%v", err)
+	}
+	c.algorithm = s.checksumAlgorithm()
+	s.cache = c
+}
+
+// countDownload adds a downloaded file to the totals.
+func (s *Syncer) countDownload(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Downloaded++
+	s.stats.Bytes += size
+}
+
+// progress describes how much has been downloaded so far and roughly how
+// long the rest will take, or returns "" before anything has been done.
+// When the disk space check has estimated the total size, the estimate is
+// based on the download rate so far; otherwise it assumes the remaining
+// albums will take as long on average as the finished ones.
+func (s *Syncer) progress(total int) string {
+	s.mu.Lock()
+	files, bytes, done := s.stats.Downloaded-s.startFiles, s.stats.Bytes-s.startBytes, s.albumsDone
+	s.mu.Unlock()
+	if done == 0 {
+		return ""
+	}
+	elapsed := time.Since(s.syncStart)
+	var left time.Duration
+	if s.expectedBytes > 0 && bytes > 0 {
+		rate := float64(bytes) / elapsed.Seconds()
+		if remaining := s.expectedBytes - bytes; remaining > 0 {
+			left = time.Duration(float64(remaining) / rate * float64(time.Second))
+		}
+	} else {
+		left = elapsed / time.Duration(done) * time.Duration(total-done)
+	}
+	return fmt.Sprintf("    downloaded %d files (%s) at %s/s so far, about %v left",
+		files, FormatSize(bytes), FormatSize(int64(float64(bytes)/elapsed.Seconds())), left.Round(time.Second))
+}
+
+// countRemoval adds a file that was deleted or moved to the trash, or that
+// would be in a dry run, to the result. When the shared file set is being
+// cleaned up, the flat layout's prefixes still tell which album a file
+// came from.
+func (s *albumJob) countRemoval(path string, size int64, trashed bool) {
+	f := File{Account: s.accountName, Album: s.album, AlbumPath: s.dir, Path: path, Size: size, Status: "deleted"}
+	if f.Album == "" {
+		if album := s.flatAlbum(path); album != nil {
+			f.Album, f.AlbumPath = album.Title, s.albumPath(album)
+		}
+	}
+	if trashed {
+		f.Status = "trashed"
+	}
+	s.emit(Event{Type: "file_deleted", Album: f.Album, Path: path, Size: size, Status: f.Status})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if trashed {
+		s.stats.Trashed++
+	} else {
+		s.stats.Deleted++
+	}
+	s.result.Deleted = append(s.result.Deleted, f)
+}
+
+// countRenumbered adds local files renamed by renumber to the totals.
+func (s *Syncer) countRenumbered(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Renumbered += n
+}
+
+// countNoOriginal adds an image with nothing to download to the totals.
+func (s *Syncer) countNoOriginal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.NoOriginal++
+}
+
+// countTooBig adds an image over the size limit to the totals.
+func (s *Syncer) countTooBig() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.TooBig++
+}
+
+// countConflict adds a local copy that changed since the server's copy to
+// the totals.
+func (s *Syncer) countConflict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Conflicts++
+}
+
+// countDir adds a directory that was removed, or that would be in a dry
+// run, to the totals.
+func (s *Syncer) countDir(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Dirs++
+	s.removedDirs[path] = true
+	s.dirs.forget(filepath.Join(s.Dir, path))
+}
+
+// countFile adds an image handled by syncFile to the result, according to
+// its manifest status.
+func (s *Syncer) countFile(f File) {
+	s.emit(fileEvent(f))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch f.Status {
+	case "moved":
+		s.stats.Moved++
+	case "linked":
+		s.stats.Linked++
+	}
+	switch f.Status {
+	case "new", "moved", "linked":
+		s.result.Downloaded = append(s.result.Downloaded, f)
+	case "changed":
+		s.result.Changed = append(s.result.Changed, f)
+	case "failed":
+		s.result.Failed = append(s.result.Failed, f)
+	default:
+		s.result.Skipped = append(s.result.Skipped, f)
+	}
+}
+
+// countError logs an error that is being skipped over and adds it to the
+// result.
+func (s *Syncer) countError(err error) {
+	s.errorf("%v", err)
+	s.addError(err)
+}
+
+// addError adds an error that is being skipped over to the result.
+func (s *Syncer) addError(err error) {
+	s.emit(Event{Type: "error", Error: err.Error()})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Errors++
+	s.result.Errors = append(s.result.Errors, err)
+}
@@ -0,0 +1,606 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/russross/smugmug"
+)
+
+// newTestSyncer returns a Syncer set up the way syncAccount leaves it,
+// syncing into a temporary directory.
+func newTestSyncer(t *testing.T) *Syncer {
+	t.Helper()
+	s := New()
+	s.Dir = t.TempDir()
+	s.CheckSpace = false
+	if err := s.prepare(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.loadCache()
+	s.orphans = newOrphanIndex()
+	s.listings = make(map[*smugmug.AlbumInfo][]*smugmug.ImageInfo)
+	s.removedDirs = make(map[string]bool)
+	return s
+}
+
+// testAlbum returns an album that was last changed an hour ago.
+func testAlbum(title string) *smugmug.AlbumInfo {
+	return &smugmug.AlbumInfo{
+		Key:         title + "Key",
+		Title:       title,
+		Category:    &smugmug.CategoryInfo{Name: "Other"},
+		LastUpdated: time.Now().Add(-time.Hour).Format("2006-01-02 15:04:05"),
+	}
+}
+
+// writeFile creates a file under dir, along with its parent directories.
+func writeFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyListingDeletesNothing(t *testing.T) {
+	s := newTestSyncer(t)
+	s.Layout = "flat"
+	trip := testAlbum("Trip")
+	other := testAlbum("Other")
+	s.flatPrefixes[trip] = "Trip_TripKey_"
+	s.flatPrefixes[other] = "Other_OtherKey_"
+	for _, name := range []string{"Trip_TripKey_a.jpg", "Trip_TripKey_b.jpg", "Other_OtherKey_c.jpg"} {
+		writeFile(t, s.Dir, name, name)
+	}
+	localFiles := newFileSet(false)
+	if err := s.scan(context.Background(), s.Dir, false, localFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the files of the album that came back empty are protected
+	mine := s.albumFiles(localFiles, trip)
+	sort.Strings(mine)
+	if len(mine) != 2 || mine[0] != "Trip_TripKey_a.jpg" || mine[1] != "Trip_TripKey_b.jpg" {
+		t.Fatalf("albumFiles = %q, want the two Trip files", mine)
+	}
+	for _, k := range mine {
+		localFiles.keep(k)
+	}
+	if err := s.newJob().cleanup(localFiles, localFiles.count()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range mine {
+		if _, err := os.Stat(filepath.Join(s.Dir, name)); err != nil {
+			t.Errorf("%s was removed after an empty listing: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "Other_OtherKey_c.jpg")); !os.IsNotExist(err) {
+		t.Errorf("unclaimed file from another album was not removed: %v", err)
+	}
+}
+
+func TestCleanupNestedEmptyDirs(t *testing.T) {
+	s := newTestSyncer(t)
+	old := filepath.Join("Other", "Old")
+	deep := filepath.Join(old, "x", "y", "z")
+	if err := os.MkdirAll(filepath.Join(s.Dir, deep), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a file still on the server keeps its directory, and those above it
+	writeFile(t, s.Dir, filepath.Join(old, "x", "w", "keep.jpg"), "keep")
+
+	// the set is in map order, so the deepest directory is rarely first
+	localFiles := newFileSet(false)
+	for _, k := range []string{old, filepath.Join(old, "x"), filepath.Join(old, "x", "y"), deep, filepath.Join(old, "x", "w")} {
+		localFiles.set(k, "directory")
+	}
+	if err := s.newJob().cleanup(localFiles, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{deep, filepath.Join(old, "x", "y")} {
+		if _, err := os.Stat(filepath.Join(s.Dir, k)); !os.IsNotExist(err) {
+			t.Errorf("empty directory %s was not removed", k)
+		}
+	}
+	for _, k := range []string{old, filepath.Join(old, "x", "w", "keep.jpg")} {
+		if _, err := os.Stat(filepath.Join(s.Dir, k)); err != nil {
+			t.Errorf("%s was removed but is not empty: %v", k, err)
+		}
+	}
+}
+
+func TestJobWarningsHeld(t *testing.T) {
+	s := newTestSyncer(t)
+	job := s.newJob()
+	job.held = true
+	job.checkTruncated(100, "images", "Other/Trip")
+	job.checkTruncated(99, "images", "Other/Trip")
+	if len(job.lines) != 1 {
+		t.Errorf("job held %d lines for a round listing, want 1", len(job.lines))
+	}
+
+	// a file that cannot be read is reported with the album too
+	job.lines = nil
+	err := job.hashScanned(filepath.Join(s.Dir, "missing.jpg"), "missing.jpg", nil, newFileSet(false), job.warnf)
+	if err == nil || len(job.lines) != 1 {
+		t.Errorf("hashScanned = %v with %d lines held, want an error and 1 line", err, len(job.lines))
+	}
+}
+
+func TestScanWorkersWarnHeldJob(t *testing.T) {
+	s := newTestSyncer(t)
+	s.hashing = newPool(4)
+	job := s.newJob()
+	job.held = true
+	// links to nowhere are walked as files but cannot be hashed
+	for i := 0; i < 8; i++ {
+		name := filepath.Join(s.Dir, fmt.Sprintf("broken%d.jpg", i))
+		if err := os.Symlink(filepath.Join(s.Dir, "missing"), name); err != nil {
+			t.Skip(err)
+		}
+	}
+	if err := job.scan(context.Background(), s.Dir, true, newFileSet(false)); err == nil {
+		t.Errorf("scan of unreadable files succeeded")
+	}
+	if len(job.lines) == 0 {
+		t.Errorf("scan held no warnings for the unreadable files")
+	}
+
+	// a cancelled run does not wait for a scan worker
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.hashing = newPool(1)
+	s.hashing <- struct{}{}
+	if err := job.scan(ctx, s.Dir, true, newFileSet(false)); err != context.Canceled {
+		t.Errorf("scan after cancelling = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCaseProbe(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a.jpg", "A.JPG"},
+		{"IMG_0001.Jpg", "img_0001.jPG"},
+		{"Åsa", "åSA"},
+		{"2024-01", "2024-01"},
+	}
+	for _, tt := range tests {
+		if got := swapCase(tt.in); got != tt.want {
+			t.Errorf("swapCase(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	insensitive := func() bool {
+		dir := t.TempDir()
+		writeFile(t, dir, "a.jpg", "a")
+		_, err := os.Stat(filepath.Join(dir, "A.JPG"))
+		return err == nil
+	}()
+
+	// an existing entry is looked up without writing anything
+	dir := t.TempDir()
+	writeFile(t, dir, "Trip/a.jpg", "a")
+	if got := caseInsensitive(dir, true); got != insensitive {
+		t.Errorf("caseInsensitive with an entry = %v, want %v", got, insensitive)
+	}
+
+	// with nothing to look up, a file is only written when allowed
+	for _, write := range []bool{false, true} {
+		dir := t.TempDir()
+		writeFile(t, dir, "2024/0001", "a")
+		got := caseInsensitive(dir, write)
+		if want := write && insensitive; got != want {
+			t.Errorf("caseInsensitive(write %v) = %v, want %v", write, got, want)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("caseInsensitive(write %v) left %d entries, want 1", write, len(entries))
+		}
+	}
+
+	// names that only differ in case are different files
+	if !insensitive {
+		dir := t.TempDir()
+		writeFile(t, dir, "a.jpg", "a")
+		writeFile(t, dir, "A.JPG", "b")
+		if caseInsensitive(dir, false) {
+			t.Errorf("caseInsensitive with a.jpg and A.JPG = true, want false")
+		}
+	}
+	if caseInsensitive(filepath.Join(t.TempDir(), "missing"), true) {
+		t.Errorf("caseInsensitive on a missing directory = true, want false")
+	}
+}
+
+func TestOverThreshold(t *testing.T) {
+	tests := []struct {
+		threshold bool
+		count     int
+		percent   float64
+		n, total  int
+		want      bool
+	}{
+		{false, 0, 0, 10, 10, false},
+		{true, 0, 0, 0, 10, false},
+		{true, 0, 0, 1, 10, true},
+		{true, 5, 0, 5, 10, false},
+		{true, 5, 0, 6, 10, true},
+		{true, 0, 50, 5, 10, false},
+		{true, 0, 50, 6, 10, true},
+		{false, 5, 0, 6, 10, true},
+	}
+	for _, tt := range tests {
+		s := New()
+		s.Threshold, s.ThresholdCount, s.ThresholdPercent = tt.threshold, tt.count, tt.percent
+		if got := s.overThreshold(tt.n, tt.total); got != tt.want {
+			t.Errorf("overThreshold(%d, %d) with %v, %d, %v%% = %v, want %v",
+				tt.n, tt.total, tt.threshold, tt.count, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestFlatCleanupKeepsForeignFiles(t *testing.T) {
+	album := testAlbum("Trip")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{album},
+		images: map[string][]*smugmug.ImageInfo{album.Key: {{Key: "abc123", FileName: "a.jpg", Format: "JPG", Size: 1,
+			MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}}},
+	}
+	useFakeServer(t, server)
+	s := New()
+	s.Dir = t.TempDir()
+	s.Layout = "flat"
+	s.CheckSpace = false
+	s.ManifestFile = filepath.Join(s.Dir, "manifest.json")
+	// named like one of the album's files, so only being ours saves it
+	s.OutputFiles = []string{filepath.Join(s.Dir, "Other_Trip_run.log")}
+	for _, name := range []string{"Other_Trip_a.jpg", "Other_Trip_old.jpg", "README", "manifest.json", "Other_Trip_run.log"} {
+		content := name
+		if name == "Other_Trip_a.jpg" {
+			content = "a"
+		}
+		writeFile(t, s.Dir, name, content)
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "Other_Trip_old.jpg")); !os.IsNotExist(err) {
+		t.Errorf("file from the album that is gone from the server was not removed: %v", err)
+	}
+	for _, name := range []string{"Other_Trip_a.jpg", "README", "manifest.json", "Other_Trip_run.log"} {
+		if _, err := os.Stat(filepath.Join(s.Dir, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+	if st := s.Stats(); st.Deleted != 1 {
+		t.Errorf("counted %d deleted files, want 1", st.Deleted)
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	album := testAlbum("Trip")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{album},
+		images: map[string][]*smugmug.ImageInfo{album.Key: {{Key: "abc123", FileName: "a.jpg", Format: "JPG", Size: 1,
+			MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}}},
+	}
+	useFakeServer(t, server)
+	dir := t.TempDir()
+	writeFile(t, dir, filepath.Join("Other", "Trip", "a.jpg"), "a")
+	writeFile(t, dir, filepath.Join("Other", "Trip", "extra.jpg"), "extra")
+	s := New()
+	s.Dir = dir
+	s.CheckSpace = false
+	s.ScanWorkers = 2
+
+	// verifying changes nothing, and turns off deleting for that run only
+	s.Verify = true
+	res, err := s.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats.Verified != 1 || res.Stats.Problems != 1 {
+		t.Errorf("verify found %d good files and %d problems, want 1 and 1", res.Stats.Verified, res.Stats.Problems)
+	}
+	if !s.Delete || !s.Fast || !s.Moves || s.Jobs != 1 || s.Dir != dir {
+		t.Errorf("Run changed the settings: delete %v, fast %v, moves %v, jobs %d, dir %q",
+			s.Delete, s.Fast, s.Moves, s.Jobs, s.Dir)
+	}
+
+	s.Verify = false
+	res, err = s.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats.Verified != 0 || res.Stats.Problems != 0 || res.Stats.Deleted != 1 || len(res.Deleted) != 1 {
+		t.Errorf("second run counted %d verified, %d problems, %d deleted; want only the 1 deletion",
+			res.Stats.Verified, res.Stats.Problems, res.Stats.Deleted)
+	}
+	if len(res.Skipped) != 1 || res.Stats.Albums != 1 {
+		t.Errorf("second run listed %d skipped files in %d albums, want 1 in 1", len(res.Skipped), res.Stats.Albums)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Other", "Trip", "extra.jpg")); !os.IsNotExist(err) {
+		t.Errorf("extra file was not removed by the second run: %v", err)
+	}
+}
+
+func TestTemplateCleanupMatchesAlbumLayout(t *testing.T) {
+	album := testAlbum("Trip")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{album},
+		images: map[string][]*smugmug.ImageInfo{album.Key: {{Key: "abc123", FileName: "a.jpg", Format: "JPG", Size: 1,
+			MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: "http://example.com/a.jpg"}}},
+	}
+	useFakeServer(t, server)
+	// what is left after syncing with the given template, or the album
+	// layout if it is ""
+	remaining := func(tmpl string) []string {
+		s := New()
+		s.Dir = t.TempDir()
+		s.CheckSpace = false
+		s.Template = tmpl
+		writeFile(t, s.Dir, filepath.Join("Other", "Trip", "a.jpg"), "a")
+		writeFile(t, s.Dir, filepath.Join("Other", "Trip", "old.jpg"), "old")
+		writeFile(t, s.Dir, filepath.Join("Other", "Trip", "sub", "x.jpg"), "x")
+		writeFile(t, s.Dir, filepath.Join("Other", "notes.txt"), "notes")
+		writeFile(t, s.Dir, filepath.Join("Other", "Gone", "g.jpg"), "g")
+		writeFile(t, s.Dir, "README", "readme")
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+				rel, _ := filepath.Rel(s.Dir, path)
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(files)
+		return files
+	}
+
+	want := remaining("")
+	if got := remaining(AlbumTemplate); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("with the album template %q are left, want %q as with the album layout", got, want)
+	}
+	if strings.Join(want, " ") != "Other/Gone/g.jpg Other/Trip/a.jpg Other/notes.txt README" {
+		t.Errorf("with the album layout %q are left", want)
+	}
+}
+
+func TestManifestListsSkippedAlbums(t *testing.T) {
+	trip, beach := testAlbum("Trip"), testAlbum("Beach")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{trip, beach},
+		images: map[string][]*smugmug.ImageInfo{
+			trip.Key:  {{Key: "abc123", FileName: "a.jpg", Format: "JPG", Size: 1, MD5Sum: "0cc175b9c0f1b6a831c399e269772661"}},
+			beach.Key: {{Key: "def456", FileName: "b.jpg", Format: "JPG", Size: 1, MD5Sum: "92eb5ffee6ae2fec3ad71c777531578f"}},
+		},
+	}
+	useFakeServer(t, server)
+	s := New()
+	s.Dir = t.TempDir()
+	s.CheckSpace = false
+	s.ManifestFile = filepath.Join(t.TempDir(), "manifest.json")
+	writeFile(t, s.Dir, filepath.Join("Other", "Trip", "a.jpg"), "a")
+	writeFile(t, s.Dir, filepath.Join("Other", "Beach", "b.jpg"), "b")
+	// the trip album is skipped for being unchanged since the last run
+	updated, err := time.ParseInLocation("2006-01-02 15:04:05", trip.LastUpdated, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(s.Dir, "Other", "Trip"), updated, updated); err != nil {
+		t.Fatal(err)
+	}
+	statuses := func() map[string]string {
+		data, err := os.ReadFile(s.ManifestFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []manifestEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string)
+		for _, e := range entries {
+			m[e.FileName] = e.Status
+		}
+		return m
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(); len(got) != 2 || got["a.jpg"] != "not synced" || got["b.jpg"] != "unchanged" {
+		t.Errorf("manifest statuses = %v, want a.jpg not synced and b.jpg unchanged", got)
+	}
+
+	// a run that fails part way still saves what it saw
+	os.Remove(s.ManifestFile)
+	bad := testAlbum("Bad")
+	bad.LastUpdated = "yesterday"
+	server.albums = append(server.albums, bad)
+	if _, err := s.Run(context.Background()); err == nil {
+		t.Fatal("run with an unreadable album timestamp succeeded")
+	}
+	if got := statuses(); len(got) != 2 {
+		t.Errorf("manifest of a failed run = %v, want the 2 images seen", got)
+	}
+
+	// and albums before the one a run starts at are listed too
+	server.albums = server.albums[:2]
+	s.Fast, s.Delete, s.StartAlbum = false, false, "Beach"
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(); len(got) != 2 || got["a.jpg"] != "not synced" || got["b.jpg"] != "unchanged" {
+		t.Errorf("manifest statuses with a start album = %v, want a.jpg not synced and b.jpg unchanged", got)
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  string // "" for an error
+	}{
+		{"http://proxy.example.com:3128", "http://proxy.example.com:3128"},
+		{"socks5://localhost:1080", "socks5://localhost:1080"},
+		{"ftp://proxy.example.com", ""},
+		{"proxy.example.com:3128", ""},
+		{"http://", ""},
+	}
+	req, _ := http.NewRequest("GET", "https://photos.smugmug.com/a.jpg", nil)
+	for _, tt := range tests {
+		proxy, err := ProxyFunc(tt.proxy)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ProxyFunc(%q) did not fail", tt.proxy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ProxyFunc(%q) = %v", tt.proxy, err)
+			continue
+		}
+		if u, err := proxy(req); err != nil || u.String() != tt.want {
+			t.Errorf("ProxyFunc(%q) sends requests to %v, %v; want %s", tt.proxy, u, err, tt.want)
+		}
+	}
+
+	// the default transport is the caller's to set up
+	def := http.DefaultTransport.(*http.Transport)
+	old := def.Proxy
+	def.Proxy = nil
+	defer func() { def.Proxy = old }()
+	s := New()
+	s.Dir = t.TempDir()
+	s.Proxy = "http://proxy.example.com:3128"
+	if err := s.prepare(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if def.Proxy != nil {
+		t.Errorf("prepare set a proxy on http.DefaultTransport")
+	}
+}
+
+func TestFileEvent(t *testing.T) {
+	tests := []struct {
+		status, want string
+	}{
+		{"new", "file_downloaded"},
+		{"changed", "file_downloaded"},
+		{"moved", "file_downloaded"},
+		{"linked", "file_downloaded"},
+		{"failed", "file_failed"},
+		{"unchanged", "file_skipped"},
+		{"conflict", "file_skipped"},
+		{"protected", "file_skipped"},
+		{"no original", "file_skipped"},
+	}
+	for _, tt := range tests {
+		f := File{Account: "me", Album: "Trip", Path: "a.jpg", Size: 10, Status: tt.status, Duration: 2 * time.Second}
+		if tt.status == "failed" {
+			f.Err = fmt.Errorf("connection reset")
+		}
+		e := fileEvent(f)
+		if e.Type != tt.want || e.Status != tt.status || e.Path != "a.jpg" || e.Account != "me" {
+			t.Errorf("fileEvent(%s) = %+v, want a %s event", tt.status, e, tt.want)
+		}
+		if (e.Seconds == 2) != (tt.want == "file_downloaded") {
+			t.Errorf("fileEvent(%s) took %v seconds", tt.status, e.Seconds)
+		}
+		if (e.Error != "") != (tt.want == "file_failed") {
+			t.Errorf("fileEvent(%s) has error %q", tt.status, e.Error)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "b")
+	}))
+	defer web.Close()
+	album := testAlbum("Trip")
+	server := &fakeServer{
+		albums: []*smugmug.AlbumInfo{album},
+		images: map[string][]*smugmug.ImageInfo{album.Key: {
+			{Key: "a", FileName: "a.jpg", Format: "JPG", Size: 1, MD5Sum: "0cc175b9c0f1b6a831c399e269772661", OriginalURL: web.URL},
+			{Key: "b", FileName: "b.jpg", Format: "JPG", Size: 1, MD5Sum: "92eb5ffee6ae2fec3ad71c777531578f", OriginalURL: web.URL},
+			{Key: "c", FileName: "c.jpg", Format: "JPG", Size: 1, MD5Sum: "4a8a08f09d37b73795649038408b5f33"},
+		}},
+	}
+	useFakeServer(t, server)
+	s := New()
+	s.Dir = t.TempDir()
+	s.CheckSpace = false
+	s.Accounts = []Account{{Name: "me", Email: "user@example.com"}}
+	// named accounts each sync into their own directory
+	writeFile(t, s.Dir, "me/Other/Trip/a.jpg", "a")
+	writeFile(t, s.Dir, "me/Other/Trip/gone.jpg", "gone")
+
+	// the events as main writes them, one JSON object per line
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	s.Events = func(e Event) { enc.Encode(e) }
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for i, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %d, %q, is not an event: %v", i+1, line, err)
+		}
+		if e.Time.IsZero() || e.Account != "me" && e.Type != "summary" {
+			t.Errorf("line %d, %q, has no time or the wrong account", i+1, line)
+		}
+		events = append(events, e)
+	}
+	byPath := make(map[string]Event)
+	var types []string
+	for _, e := range events {
+		if strings.HasPrefix(e.Type, "file_") {
+			byPath[filepath.Base(e.Path)] = e
+		}
+		types = append(types, e.Type)
+	}
+	want := map[string]struct{ typ, status string }{
+		"a.jpg":    {"file_skipped", "unchanged"},
+		"b.jpg":    {"file_downloaded", "new"},
+		"c.jpg":    {"file_skipped", "no original"},
+		"gone.jpg": {"file_deleted", ""},
+	}
+	for name, w := range want {
+		if e := byPath[name]; e.Type != w.typ || w.status != "" && e.Status != w.status {
+			t.Errorf("event for %s = %+v, want %s %s", name, e, w.typ, w.status)
+		}
+	}
+	if len(types) == 0 || types[len(types)-1] != "summary" {
+		t.Errorf("events %v do not end with the summary", types)
+	} else if st := events[len(events)-1].Stats; st == nil || st.Downloaded != 1 || st.Deleted != 1 {
+		t.Errorf("summary stats = %+v, want 1 download and 1 deletion", st)
+	}
+	if !strings.Contains(strings.Join(types, " "), "album_started") {
+		t.Errorf("events %v have no album_started", types)
+	}
+}
@@ -0,0 +1,211 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter caps the combined rate of all downloads. Each read reserves time
+// on a shared schedule and then waits until that time has arrived, so the
+// total throughput across goroutines stays under the limit.
+type limiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second
+	next time.Time // when the bytes handed out so far will have been earned
+}
+
+func newLimiter(bytesPerSecond int64) *limiter {
+	return &limiter{rate: float64(bytesPerSecond)}
+}
+
+// wait blocks until n more bytes fit under the limit or ctx is cancelled.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than l allows.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// keep reads small so the rate stays smooth
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.wait(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// ParseSize parses a byte count such as "2MB", "500k", or "1.5g". Suffixes
+// are powers of 1024 and are not case sensitive; a trailing "b" is
+// optional.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(num, "k"):
+		scale = 1024
+	case strings.HasSuffix(num, "m"):
+		scale = 1024 * 1024
+	case strings.HasSuffix(num, "g"):
+		scale = 1024 * 1024 * 1024
+	}
+	if scale > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * scale), nil
+}
+
+// FormatSize formats a byte count for logging, e.g. "1.5m", "20.0k", or
+// "12 bytes".
+func FormatSize(n int64) string {
+	switch {
+	case n > 1024*1024:
+		return fmt.Sprintf("%.1fm", float64(n)/(1024*1024))
+	case n > 1024:
+		return fmt.Sprintf("%.1fk", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// hostLimiter caps how many downloads run at once from each host, and
+// lets a server that asks us to slow down hold off every download, not
+// just the one that was told.
+type hostLimiter struct {
+	mu    sync.Mutex
+	max   int // per host, or 0 for no limit
+	slots map[string]chan struct{}
+	until time.Time // no new requests are started before this
+}
+
+func newHostLimiter(max int) *hostLimiter {
+	return &hostLimiter{max: max, slots: make(map[string]chan struct{})}
+}
+
+// acquire waits until a request to host may start, and returns the
+// function to call once it is finished.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	for {
+		h.mu.Lock()
+		delay := time.Until(h.until)
+		h.mu.Unlock()
+		if delay <= 0 {
+			break
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if h.max <= 0 {
+		return func() {}, nil
+	}
+
+	h.mu.Lock()
+	slot, ok := h.slots[host]
+	if !ok {
+		slot = make(chan struct{}, h.max)
+		h.slots[host] = slot
+	}
+	h.mu.Unlock()
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pause stops new requests from starting for d.
+func (h *hostLimiter) pause(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if until := time.Now().Add(d); until.After(h.until) {
+		h.until = until
+	}
+}
+
+// pool caps how many of something run at once across all jobs, such as
+// files being hashed or downloaded. A nil pool has no limit.
+type pool chan struct{}
+
+func newPool(max int) pool {
+	if max <= 0 {
+		return nil
+	}
+	return make(pool, max)
+}
+
+// acquire waits for a free slot and returns the function to call to give
+// it back.
+func (p pool) acquire(ctx context.Context) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	select {
+	case p <- struct{}{}:
+		return func() { <-p }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, into how long to wait from now.
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
@@ -0,0 +1,53 @@
+package syncer
+
+import (
+	"sort"
+
+	"github.com/russross/smugmug"
+)
+
+// verifyFile checks the local copy of image against the server's listing
+// for --verify and returns the manifest status for it. Only originals can
+// be compared by MD5 sum; for videos and resized copies it is enough that
+// the file exists.
+func (s *albumJob) verifyFile(image *smugmug.ImageInfo, path string, localFiles *fileSet) string {
+	local := localFiles.get(path)
+	s.keepImage(path, localFiles)
+	switch {
+	case local == "":
+		s.countProblem("    %s: missing", path)
+		return "missing"
+	case !isVideo(image.Format) && s.Size == "original" && local != image.MD5Sum:
+		s.countProblem("    %s: MD5 sum %s does not match the server's %s", path, local, image.MD5Sum)
+		return "mismatch"
+	}
+	s.debugf("    %s: ok", path)
+	s.mu.Lock()
+	s.stats.Verified++
+	s.mu.Unlock()
+	return "verified"
+}
+
+// reportExtras reports the local files that no image claimed, which cleanup
+// would otherwise have removed.
+func (s *albumJob) reportExtras(localFiles *fileSet) {
+	var extra []string
+	for k, v := range localFiles.entries() {
+		if v != "directory" {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		s.countProblem("    %s: not on the server", k)
+	}
+}
+
+// countProblem logs a discrepancy found by --verify and adds it to the
+// total.
+func (s *albumJob) countProblem(format string, v ...interface{}) {
+	s.warnf(format, v...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Problems++
+}